@@ -5,18 +5,23 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/SynologyOpenSource/synology-csi/pkg/audit"
 	"github.com/SynologyOpenSource/synology-csi/pkg/driver"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/service"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
 	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
 )
 
 var (
@@ -28,8 +33,23 @@ var (
 
 	// Logging
 	logLevel       = "info"
+	logFormat      = logger.LogFormatText
 	webapiDebug    = false
 	multipathForUC = true
+
+	// Tracing
+	tracingExporter    = ""
+	tracingEndpoint    = ""
+	tracingInsecure    = false
+	tracingFile        = "/var/log/synology-csi-traces.json"
+	tracingSampleRatio = 1.0
+
+	// Audit
+	auditSink       = ""
+	auditFile       = "/var/log/synology-csi-audit.log"
+	auditMaxSizeMB  = 100
+	auditMaxBackups = 5
+	auditUrl        = ""
 )
 
 var rootCmd = &cobra.Command{
@@ -41,7 +61,7 @@ var rootCmd = &cobra.Command{
 			logger.WebapiDebug = true
 			logLevel = "debug"
 		}
-		logger.Init(logLevel)
+		logger.Init(logLevel, logFormat)
 
 		if !multipathForUC {
 			driver.MultipathEnabled = false
@@ -56,11 +76,55 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+var preflightCmd = &cobra.Command{
+	Use:          "preflight",
+	Short:        "Check the prerequisites of the node plugin on this node",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger.Init(logLevel, logFormat)
+
+		return driver.RunPreflight()
+	},
+}
+
 func driverStart() error {
 	log.Infof("CSI Options = {%s, %s, %s}", csiNodeID, csiEndpoint, csiClientInfoPath)
 
+	shutdownTracing, err := tracing.Init(tracing.Config{
+		Exporter:    tracingExporter,
+		Endpoint:    tracingEndpoint,
+		Insecure:    tracingInsecure,
+		File:        tracingFile,
+		ServiceName: driver.DriverName,
+		SampleRatio: tracingSampleRatio,
+	})
+	if err != nil {
+		log.Errorf("Failed to init tracing: %v", err)
+		return err
+	}
+	defer func() {
+		// flush the pending spans
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("Failed to shutdown tracing: %v", err)
+		}
+	}()
+
+	if err := audit.Init(audit.Config{
+		Sink:       auditSink,
+		File:       auditFile,
+		MaxSizeMB:  auditMaxSizeMB,
+		MaxBackups: auditMaxBackups,
+		Url:        auditUrl,
+	}); err != nil {
+		log.Errorf("Failed to init audit: %v", err)
+		return err
+	}
+	defer audit.Close()
+
 	// 1. Compile templates
-	err := models.CompileTemplates()
+	err = models.CompileTemplates()
 	if err != nil {
 		log.Errorf("Failed to compile templates: %v", err)
 		return err
@@ -101,6 +165,7 @@ func driverStart() error {
 
 func main() {
 	addFlags(rootCmd)
+	rootCmd.AddCommand(preflightCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -114,8 +179,46 @@ func addFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().StringVarP(&csiEndpoint, "endpoint", "e", csiEndpoint, "CSI endpoint")
 	cmd.PersistentFlags().StringVarP(&csiClientInfoPath, "client-info", "f", csiClientInfoPath, "Path of Synology config yaml file")
 	cmd.PersistentFlags().StringVar(&logLevel, "log-level", logLevel, "Log level (debug, info, warn, error, fatal)")
+	cmd.PersistentFlags().StringVar(&logFormat, "log-format", logFormat, "Log format (text, json)")
 	cmd.PersistentFlags().BoolVarP(&webapiDebug, "debug", "d", webapiDebug, "Enable webapi debugging logs")
 	cmd.PersistentFlags().BoolVar(&multipathForUC, "multipath", multipathForUC, "Set to 'false' to disable multipath for UC")
+	cmd.PersistentFlags().StringVar(&driver.StagingRecordDir, "staging-record-dir", driver.StagingRecordDir, "Directory on the node to persist the records of staged volumes")
+	cmd.PersistentFlags().DurationVar(&driver.SessionCheckInterval, "iscsi-session-check-interval", driver.SessionCheckInterval, "Interval to check and repair the iSCSI sessions of staged volumes, 0 to disable")
+	cmd.PersistentFlags().DurationVar(&driver.ReclaimInterval, "reclaim-interval", driver.ReclaimInterval, "Interval to fstrim the staged thin-provisioned iSCSI volumes, 0 to disable")
+	cmd.PersistentFlags().DurationVar(&driver.ReclaimJitter, "reclaim-jitter", driver.ReclaimJitter, "Maximum random delay added to the reclaim interval of each volume")
+	cmd.PersistentFlags().IntVar(&driver.ReclaimConcurrency, "reclaim-concurrency", driver.ReclaimConcurrency, "Maximum number of volumes to fstrim at the same time")
+	cmd.PersistentFlags().StringVar(&driver.EphemeralStagingDir, "ephemeral-staging-dir", driver.EphemeralStagingDir, "Directory on the node to stage the ephemeral inline volumes")
+	cmd.PersistentFlags().DurationVar(&driver.EphemeralGCInterval, "ephemeral-gc-interval", driver.EphemeralGCInterval, "Interval to delete the orphaned backing volumes of ephemeral inline volumes, 0 to disable")
+	cmd.PersistentFlags().StringVar(&driver.EphemeralMaxSize, "ephemeral-max-size", driver.EphemeralMaxSize, "Maximum size of an ephemeral inline volume, e.g. 10Gi, 0 for no limit")
+	cmd.PersistentFlags().StringSliceVar(&driver.EphemeralDsms, "ephemeral-dsms", driver.EphemeralDsms, "DSM addresses allowed in the dsm attribute of ephemeral inline volumes")
+	cmd.PersistentFlags().StringSliceVar(&driver.EphemeralLocations, "ephemeral-locations", driver.EphemeralLocations, "DSM volume paths allowed in the location attribute of ephemeral inline volumes, e.g. /volume1")
+	cmd.PersistentFlags().Int64Var(&driver.MaxVolumesPerNode, "max-volumes-per-node", driver.MaxVolumesPerNode, "Maximum number of volumes attachable to the node, 0 for no limit")
+	cmd.PersistentFlags().IntVar(&driver.DsmMaxTargets, "dsm-max-targets", driver.DsmMaxTargets, "Maximum number of iSCSI targets of each DSM, reported in the metrics")
+	cmd.PersistentFlags().StringVar(&driver.InitiatorNameFile, "initiator-name-file", driver.InitiatorNameFile, "File of the iSCSI initiator name of the node, reported as the node annotation "+driver.DriverName+"/initiator-iqn")
+	cmd.PersistentFlags().BoolVar(&driver.PreflightEnabled, "preflight", driver.PreflightEnabled, "Check the node prerequisites at startup and report the failures as not ready in Probe")
+	cmd.PersistentFlags().DurationVar(&driver.PreflightInterval, "preflight-interval", driver.PreflightInterval, "Interval to re-run the preflight checks for Probe, 0 to only check at startup")
+	cmd.PersistentFlags().StringSliceVar(&driver.PreflightSkip, "preflight-skip", driver.PreflightSkip, "Preflight checks to skip, e.g. iscsiadm,iscsid,iscsi_tcp,initiator-name,multipathd for SMB-only nodes")
+	cmd.PersistentFlags().IntVar(&webapi.BreakerThreshold, "dsm-breaker-threshold", webapi.BreakerThreshold, "Number of DSM webapi calls in a row failing to reach a DSM to open its circuit breaker, 0 to disable")
+	cmd.PersistentFlags().DurationVar(&webapi.BreakerCooldown, "dsm-breaker-cooldown", webapi.BreakerCooldown, "Time the webapi calls to a DSM fail at once after its circuit breaker opened")
+	cmd.PersistentFlags().DurationVar(&driver.DsmPingInterval, "dsm-ping-interval", driver.DsmPingInterval, "Interval to ping the DSMs for Probe and the metrics, 0 to disable")
+	cmd.PersistentFlags().BoolVar(&driver.DsmHealthProbe, "dsm-health-probe", driver.DsmHealthProbe, "Report not ready in Probe when no DSM answered the last ping, for the controller plugin")
+	cmd.PersistentFlags().IntVar(&driver.DsmMaxLuns, "dsm-max-luns", driver.DsmMaxLuns, "Maximum number of LUNs of each DSM, reported in the metrics")
+	cmd.PersistentFlags().IntVar(&driver.DsmMaxShares, "dsm-max-shares", driver.DsmMaxShares, "Maximum number of shared folders of each DSM, reported in the metrics")
+	cmd.PersistentFlags().StringVar(&driver.MetricsAddress, "metrics-address", driver.MetricsAddress, "Address to serve the Prometheus metrics on /metrics, e.g. :9090, empty to disable")
+	cmd.PersistentFlags().BoolVar(&driver.MetricsDsmStats, "metrics-dsm-stats", driver.MetricsDsmStats, "Report the volume capacity and the LUN, target and share counts of the DSMs in the metrics")
+	cmd.PersistentFlags().StringVar(&tracingExporter, "tracing-exporter", tracingExporter, "Exporter of the traces of CSI requests (otlp, stdout, file), empty to disable tracing")
+	cmd.PersistentFlags().StringVar(&tracingEndpoint, "tracing-endpoint", tracingEndpoint, "host:port of the OTLP gRPC receiver, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	cmd.PersistentFlags().BoolVar(&tracingInsecure, "tracing-insecure", tracingInsecure, "Connect to the OTLP receiver without TLS")
+	cmd.PersistentFlags().StringVar(&tracingFile, "tracing-file", tracingFile, "File to write the traces to with the file exporter")
+	cmd.PersistentFlags().Float64Var(&tracingSampleRatio, "tracing-sample-ratio", tracingSampleRatio, "Ratio of the CSI requests to trace, unless the caller has sampled the trace")
+	cmd.PersistentFlags().StringVar(&auditSink, "audit-sink", auditSink, "Sink of the audit records of the mutating DSM webapi calls (file, http), empty to disable the audit")
+	cmd.PersistentFlags().StringVar(&auditFile, "audit-file", auditFile, "File to append the audit records to as JSON lines with the file sink")
+	cmd.PersistentFlags().IntVar(&auditMaxSizeMB, "audit-max-size", auditMaxSizeMB, "Size in MB to rotate the audit file, 0 to never rotate")
+	cmd.PersistentFlags().IntVar(&auditMaxBackups, "audit-max-backups", auditMaxBackups, "Number of the rotated audit files to keep")
+	cmd.PersistentFlags().StringVar(&auditUrl, "audit-url", auditUrl, "URL to post each audit record to as a JSON line with the http sink")
+	cmd.PersistentFlags().StringVar(&driver.Krb5CacheDir, "krb5-cache-dir", driver.Krb5CacheDir, "Directory on the node of the Kerberos credential caches for sec=krb5 SMB mounts")
+	cmd.PersistentFlags().StringVar(&driver.SmbGrantsNamespace, "smb-grants-namespace", driver.SmbGrantsNamespace, "Namespace of the ConfigMaps tracking the SMB share permissions granted by the nodes")
+	cmd.PersistentFlags().BoolVar(&driver.SmbAllowUnsealed, "smb-allow-unsealed", driver.SmbAllowUnsealed, "Allow smb_seal=false in the StorageClasses, otherwise every SMB share requires SMB3 encryption")
 	cmd.PersistentFlags().StringVar(&fsGroupChangePolicy, "fsgroup-change-policy", fsGroupChangePolicy, "Set FSGroupChangePolicy for PVCs (Valid values: OnRootMismatch, Always, None)")
 	cmd.PersistentFlags().StringVar(&models.TargetPrefix, "iscsi-target-prefix", models.TargetPrefix, "Set iscsi target prefix")
 	cmd.PersistentFlags().StringVar(&models.IqnPrefix, "iscsi-iqn-prefix", models.IqnPrefix, "Set iscsi iqn prefix")
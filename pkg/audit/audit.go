@@ -0,0 +1,182 @@
+// Copyright 2023 Synology Inc.
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+	"github.com/SynologyOpenSource/synology-csi/pkg/metrics"
+)
+
+const (
+	SinkNone = ""
+	SinkFile = "file"
+	SinkHttp = "http"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// the webapi methods which don't change anything on DSM, all the others are audited
+var readOnlyMethods = map[string]bool{
+	"list":          true,
+	"get":           true,
+	"info":          true,
+	"list_snapshot": true,
+	"get_snapshot":  true,
+	"login":         true,
+	"logout":        true,
+}
+
+// Record is a mutating webapi call, written as a JSON line
+type Record struct {
+	Time            time.Time         `json:"time"`
+	RequestId       string            `json:"request_id,omitempty"`
+	Rpc             string            `json:"rpc,omitempty"`
+	Pvc             string            `json:"pvc,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	VolumeId        string            `json:"volume_id,omitempty"`
+	Dsm             string            `json:"dsm"`
+	DsmSerial       string            `json:"dsm_serial,omitempty"`
+	Api             string            `json:"api"`
+	Method          string            `json:"method"`
+	Params          map[string]string `json:"params"`
+	Form            map[string]string `json:"form,omitempty"` // the POST form, e.g. the shareinfo of a new share
+	Outcome         string            `json:"outcome"`
+	ErrorCode       int               `json:"error_code,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds"`
+}
+
+type Sink interface {
+	Write(record *Record) error
+	Close() error
+}
+
+type Config struct {
+	Sink       string
+	File       string
+	MaxSizeMB  int // rotate the file once it exceeds the size, 0 to never rotate
+	MaxBackups int
+	Url        string
+}
+
+// Request is the CSI request of the webapi calls, see WithRequest
+type Request struct {
+	RequestId string
+	Rpc       string
+	Pvc       string
+	Namespace string
+	VolumeId  string
+}
+
+type requestKey struct{}
+
+var sink Sink
+
+// Init opens the sink of the audit records, nothing is audited if the sink is none
+func Init(config Config) error {
+	var err error
+
+	switch config.Sink {
+	case SinkNone:
+		return nil
+	case SinkFile:
+		sink, err = newFileSink(config.File, int64(config.MaxSizeMB)*1024*1024, config.MaxBackups)
+	case SinkHttp:
+		sink, err = newHttpSink(config.Url)
+	default:
+		return fmt.Errorf("Unknown audit sink: %s", config.Sink)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to open %s audit sink: %v", config.Sink, err)
+	}
+
+	log.Infof("Audit the mutating DSM webapi calls to %s sink", config.Sink)
+	return nil
+}
+
+func Close() {
+	if sink == nil {
+		return
+	}
+	if err := sink.Close(); err != nil {
+		log.Errorf("Failed to close audit sink: %v", err)
+	}
+	sink = nil
+}
+
+// WithRequest returns a copy of ctx whose webapi calls are audited as the calls of the CSI request
+func WithRequest(ctx context.Context, request Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, request)
+}
+
+func IsMutating(method string) bool {
+	return !readOnlyMethods[method]
+}
+
+// maskParams returns the webapi parameters except api and method, with the secrets masked
+func maskParams(params url.Values) map[string]string {
+	masked := make(map[string]string)
+	for key := range params {
+		if key == "api" || key == "method" {
+			continue
+		}
+		if logger.IsSecretKey(key) {
+			masked[key] = "***"
+		} else {
+			masked[key] = logger.Redact(params.Get(key))
+		}
+	}
+	return masked
+}
+
+// Log writes the record of a mutating webapi call, the secrets of the parameters and the form are masked
+func Log(ctx context.Context, dsm string, dsmSerial string, params url.Values, form url.Values, start time.Time, errorCode int, err error) {
+	if sink == nil || !IsMutating(params.Get("method")) {
+		return
+	}
+
+	record := &Record{
+		Time:            start.UTC(),
+		Dsm:             dsm,
+		DsmSerial:       dsmSerial,
+		Api:             params.Get("api"),
+		Method:          params.Get("method"),
+		Params:          maskParams(params),
+		Outcome:         OutcomeSuccess,
+		ErrorCode:       errorCode,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if ctx != nil {
+		if request, ok := ctx.Value(requestKey{}).(Request); ok {
+			record.RequestId = request.RequestId
+			record.Rpc = request.Rpc
+			record.Pvc = request.Pvc
+			record.Namespace = request.Namespace
+			record.VolumeId = request.VolumeId
+		}
+	}
+	if len(form) > 0 {
+		record.Form = maskParams(form)
+	}
+	if err != nil {
+		record.Outcome = OutcomeFailure
+		record.Error = logger.Redact(err.Error())
+	}
+
+	if err := sink.Write(record); err != nil {
+		reason := "error"
+		if err == errQueueFull {
+			reason = "queue_full"
+		}
+		metrics.AuditRecordsDropped.WithLabelValues(reason).Inc()
+		log.Errorf("Failed to write audit record of %s.%s on DSM[%s]: %v", record.Api, record.Method, dsm, err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Synology Inc.
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordSink struct {
+	records []*Record
+}
+
+func (s *recordSink) Write(record *Record) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *recordSink) Close() error {
+	return nil
+}
+
+func TestLog(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      url.Values
+		form        url.Values
+		err         error
+		wantAudited bool
+		wantParams  map[string]string
+		wantForm    map[string]string
+		wantError   string
+	}{
+		{
+			name:        "read only",
+			params:      url.Values{"api": {"SYNO.Core.ISCSI.LUN"}, "method": {"list"}},
+			wantAudited: false,
+		},
+		{
+			name:        "secret key",
+			params:      url.Values{"api": {"SYNO.Core.User"}, "method": {"create"}, "name": {"k8s-csi"}, "password": {"Pa55word"}},
+			wantAudited: true,
+			wantParams:  map[string]string{"name": "k8s-csi", "password": "***"},
+		},
+		{
+			name:        "form",
+			params:      url.Values{"api": {"SYNO.Core.Share.Crypto"}, "method": {"decrypt"}, "name": {`"share"`}},
+			form:        url.Values{"password": {`"Pa55word"`}},
+			wantAudited: true,
+			wantParams:  map[string]string{"name": `"share"`},
+			wantForm:    map[string]string{"password": "***"},
+		},
+		{
+			name:        "failure",
+			params:      url.Values{"api": {"SYNO.Core.ISCSI.LUN"}, "method": {"delete"}, "uuid": {"1234"}},
+			err:         fmt.Errorf("DSM Api error. Error code:18990500"),
+			wantAudited: true,
+			wantParams:  map[string]string{"uuid": "1234"},
+			wantError:   "DSM Api error. Error code:18990500",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &recordSink{}
+			sink = s
+			defer func() { sink = nil }()
+
+			Log(context.Background(), "10.0.0.1", "", tt.params, tt.form, time.Now(), 0, tt.err)
+
+			if got := len(s.records) > 0; got != tt.wantAudited {
+				t.Fatalf("Log() audited = %v, want %v", got, tt.wantAudited)
+			}
+			if !tt.wantAudited {
+				return
+			}
+			record := s.records[0]
+			if !reflect.DeepEqual(record.Params, tt.wantParams) {
+				t.Errorf("Log() params = %v, want %v", record.Params, tt.wantParams)
+			}
+			if !reflect.DeepEqual(record.Form, tt.wantForm) {
+				t.Errorf("Log() form = %v, want %v", record.Form, tt.wantForm)
+			}
+			if record.Error != tt.wantError {
+				t.Errorf("Log() error = %v, want %v", record.Error, tt.wantError)
+			}
+			wantOutcome := OutcomeSuccess
+			if tt.err != nil {
+				wantOutcome = OutcomeFailure
+			}
+			if record.Outcome != wantOutcome {
+				t.Errorf("Log() outcome = %v, want %v", record.Outcome, wantOutcome)
+			}
+		})
+	}
+}
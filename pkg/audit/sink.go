@@ -0,0 +1,201 @@
+// Copyright 2023 Synology Inc.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/metrics"
+)
+
+const (
+	httpSinkTimeout   = 5 * time.Second
+	httpSinkQueueSize = 1024
+)
+
+var errQueueFull = errors.New("Audit queue is full")
+
+// fileSink appends the records as JSON lines, and rotates the file to <file>.1, <file>.2, ... by size
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	s := &fileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups <= 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("Failed to rotate %s: %v", s.path, err)
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// httpSink posts each record as a JSON line to the collector in the background, so a slow or unreachable collector
+// doesn't delay the webapi calls. The records are dropped once the queue is full.
+type httpSink struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan *Record
+	done   chan struct{}
+}
+
+func newHttpSink(url string) (*httpSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("No url of the http sink")
+	}
+	s := &httpSink{
+		url:    url,
+		client: &http.Client{Timeout: httpSinkTimeout},
+		queue:  make(chan *Record, httpSinkQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *httpSink) run() {
+	defer close(s.done)
+	for record := range s.queue {
+		if err := s.post(record); err != nil {
+			metrics.AuditRecordsDropped.WithLabelValues("error").Inc()
+			log.Errorf("Failed to post audit record of %s.%s on DSM[%s]: %v", record.Api, record.Method, record.Dsm, err)
+		}
+	}
+}
+
+func (s *httpSink) post(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	resp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Bad response status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSink) Write(record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("Audit sink is closed")
+	}
+
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// Close waits for the queued records to be posted, up to the timeout of a post
+func (s *httpSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(httpSinkTimeout):
+		return fmt.Errorf("%d audit records are not posted", len(s.queue))
+	}
+}
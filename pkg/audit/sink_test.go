@@ -0,0 +1,101 @@
+// Copyright 2023 Synology Inc.
+
+package audit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_fileSink_rotate(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBackups  int
+		records     int
+		wantFiles   []string
+		wantMissing []string
+	}{
+		{name: "no rotation", maxBackups: 2, records: 1, wantFiles: []string{"audit.log"}, wantMissing: []string{"audit.log.1"}},
+		{name: "rotate", maxBackups: 2, records: 2, wantFiles: []string{"audit.log", "audit.log.1"}, wantMissing: []string{"audit.log.2"}},
+		{name: "max backups", maxBackups: 2, records: 4, wantFiles: []string{"audit.log", "audit.log.1", "audit.log.2"}, wantMissing: []string{"audit.log.3"}},
+		{name: "no backups", maxBackups: 0, records: 3, wantFiles: []string{"audit.log"}, wantMissing: []string{"audit.log.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// every record exceeds the size, so each write after the first rotates the file
+			s, err := newFileSink(filepath.Join(dir, "audit.log"), 1, tt.maxBackups)
+			if err != nil {
+				t.Fatalf("newFileSink() error = %v", err)
+			}
+			for i := 0; i < tt.records; i++ {
+				if err := s.Write(&Record{Dsm: "10.0.0.1", Api: "SYNO.Core.ISCSI.LUN", Method: "create"}); err != nil {
+					t.Fatalf("fileSink.Write() error = %v", err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("fileSink.Close() error = %v", err)
+			}
+
+			for _, file := range tt.wantFiles {
+				if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+					t.Errorf("fileSink.Write() %s error = %v", file, err)
+				}
+			}
+			for _, file := range tt.wantMissing {
+				if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+					t.Errorf("fileSink.Write() %s exists, want missing", file)
+				}
+			}
+		})
+	}
+}
+
+func Test_httpSink_Write(t *testing.T) {
+	received := make(chan struct{}, httpSinkQueueSize+1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // a collector which doesn't respond
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	s, err := newHttpSink(server.URL)
+	if err != nil {
+		t.Fatalf("newHttpSink() error = %v", err)
+	}
+
+	// the first record is being posted, the others fill the queue
+	start := time.Now()
+	for i := 0; i < httpSinkQueueSize+1; i++ {
+		if err := s.Write(&Record{Method: "create"}); err != nil {
+			t.Fatalf("httpSink.Write() error = %v", err)
+		}
+		if i == 0 {
+			for len(s.queue) != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if err := s.Write(&Record{Method: "create"}); err != errQueueFull {
+		t.Errorf("httpSink.Write() error = %v, want %v", err, errQueueFull)
+	}
+	if elapsed := time.Since(start); elapsed > httpSinkTimeout {
+		t.Errorf("httpSink.Write() blocked for %v", elapsed)
+	}
+
+	close(release)
+	if err := s.Close(); err != nil {
+		t.Errorf("httpSink.Close() error = %v", err)
+	}
+	if len(received) != httpSinkQueueSize+1 {
+		t.Errorf("httpSink posted %d records, want %d", len(received), httpSinkQueueSize+1)
+	}
+	if err := s.Write(&Record{Method: "create"}); err == nil {
+		t.Errorf("httpSink.Write() after Close error = nil, want error")
+	}
+}
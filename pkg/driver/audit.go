@@ -0,0 +1,49 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/audit"
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+)
+
+// the PVC of CreateVolume, passed by the provisioner with --extra-create-metadata
+const (
+	auditPvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	auditPvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// auditGRPC tags the webapi calls of the request, so their audit records tell the CSI request and the PVC
+func auditGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	request := audit.Request{
+		RequestId: logger.RequestId(ctx),
+		Rpc:       info.FullMethod,
+	}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok {
+		request.VolumeId = r.GetVolumeId()
+	}
+	if r, ok := req.(interface{ GetParameters() map[string]string }); ok {
+		request.Pvc = r.GetParameters()[auditPvcNameKey]
+		request.Namespace = r.GetParameters()[auditPvcNamespaceKey]
+	}
+
+	return handler(audit.WithRequest(ctx, request), req)
+}
@@ -31,6 +31,7 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
 	"github.com/SynologyOpenSource/synology-csi/pkg/models"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
@@ -130,6 +131,10 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		snapshotNameTemplateKey        = "snapshot_name_template"
 		snapshotDescriptionTemplateKey = "snapshot_description_template"
 		recycleBinKey                  = "recycle_bin"
+		sharedTargetKey                = "shared_target"
+		multipathPortalsKey            = "multipath_portals"
+		targetInterfacesKey            = "target_interfaces"
+		reclaimSpaceKey                = "reclaim_space"
 	)
 
 	pvcName := ""
@@ -153,6 +158,28 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		enableRecycleBin = utils.StringToBoolean(params[recycleBinKey])
 	}
 
+	sharedTarget := utils.StringToBoolean(params[sharedTargetKey])
+
+	targetInterfaces := []string{}
+	if params[targetInterfacesKey] != "" {
+		for _, ifname := range strings.Split(params[targetInterfacesKey], ",") {
+			ifname = strings.TrimSpace(ifname)
+			if ifname == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %s: %q", targetInterfacesKey, params[targetInterfacesKey])
+			}
+			targetInterfaces = append(targetInterfaces, ifname)
+		}
+	}
+
+	multipathPortals := strings.TrimSpace(params[multipathPortalsKey])
+	if multipathPortals != "" {
+		if _, err := parseMultipathPortals(multipathPortals); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+		}
+		// each path is a session of the same initiator
+		multiSession = true
+	}
+
 	protocol := strings.ToLower(params["protocol"])
 	if protocol == "" {
 		protocol = utils.ProtocolDefault
@@ -160,6 +187,56 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "Unsupported volume protocol")
 	}
 
+	fsType := params["fsType"]
+	for _, cap := range volCap {
+		if cap.GetMount().GetFsType() != "" {
+			fsType = cap.GetMount().GetFsType()
+		}
+	}
+	if protocol == utils.ProtocolIscsi {
+		if _, err := parseFsOptions(fsType, params); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+		}
+	}
+
+	smbPrincipals := map[string][]string{}
+	volumeUser := protocol == utils.ProtocolSmb && utils.StringToBoolean(params[smbVolumeUserKey])
+	if volumeUser && (pvcName == "" || pvcNamespace == "") {
+		return nil, status.Errorf(codes.InvalidArgument, "%s requires the PVC name and namespace, enable --extra-create-metadata of the provisioner", smbVolumeUserKey)
+	}
+	var smbOpts *smbOptions
+	if protocol == utils.ProtocolSmb {
+		smbOpts, err = parseSmbOptions(params)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+		}
+		for userGroupType, key := range map[string]string{
+			models.UserGroupTypeDomainUser:  smbDomainUsersKey,
+			models.UserGroupTypeDomainGroup: smbDomainGroupsKey,
+		} {
+			principals, err := parseSmbPrincipals(key, params[key])
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
+			}
+			smbPrincipals[userGroupType] = principals
+		}
+		for _, cap := range volCap {
+			if err := validateSmbMountFlags(cap.GetMount().GetMountFlags(), smbOpts.Seal); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid mount options: %v", err)
+			}
+		}
+	}
+
+	// iSCSI volumes are encrypted by LUKS on the node, SMB volumes are encrypted shares on DSM
+	shareEncrypted := protocol == utils.ProtocolSmb && utils.StringToBoolean(params[encryptedKey])
+	shareEncryptionKey := ""
+	if protocol == utils.ProtocolSmb {
+		shareEncryptionKey = req.GetSecrets()[encryptionPassphraseKey]
+		if shareEncrypted && shareEncryptionKey == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Missing %s in the provisioner secret for the encrypted share", encryptionPassphraseKey)
+		}
+	}
+
 	sg, err := models.NewStringGenerator(volName, protocol, params)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v", err)
@@ -201,13 +278,17 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		LunDescription:   description,
 		ShareDescription: description,
 		RecycleBin:       enableRecycleBin,
+		SharedTarget:     sharedTarget,
+		TargetInterfaces: targetInterfaces,
+		Encrypted:        shareEncrypted,
+		EncryptionKey:    shareEncryptionKey,
 	}
 
 	// idempotency
 	// Note: an SMB PV may not be tested existed precisely because the share folder name was sliced from k8sVolumeName
-	k8sVolume := cs.dsmService.GetVolumeByName(lunName, shareName)
+	k8sVolume := cs.dsmService.WithContext(ctx).GetVolumeByName(lunName, shareName)
 	if k8sVolume == nil {
-		k8sVolume, err = cs.dsmService.CreateVolume(spec)
+		k8sVolume, err = cs.dsmService.WithContext(ctx).CreateVolume(spec)
 		if err != nil {
 			return nil, err
 		}
@@ -221,28 +302,155 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Errorf(codes.AlreadyExists, "Already existing volume name with different capacity")
 	}
 
+	volumeUserName := ""
+	if k8sVolume.Protocol == utils.ProtocolSmb {
+		if smbOpts.Seal {
+			dsm, err := cs.dsmService.WithContext(ctx).GetDsm(k8sVolume.DsmIp)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s]", k8sVolume.DsmIp))
+			}
+			if err := enableSMBEncryption(dsm, k8sVolume.Share.Name); err != nil {
+				return nil, status.Errorf(codes.Internal, err.Error())
+			}
+		}
+		if err := cs.grantSMBPrincipals(ctx, k8sVolume, smbPrincipals); err != nil {
+			return nil, err
+		}
+		if volumeUser {
+			volumeUserName, err = cs.createVolumeUser(ctx, k8sVolume, volName, pvcName, pvcNamespace)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	volumeContext := map[string]string{
+		"dsm":                  k8sVolume.DsmIp,
+		"protocol":             k8sVolume.Protocol,
+		"source":               k8sVolume.Source,
+		"is_thin_provisioning": strconv.FormatBool(isThin),
+	}
+	if k8sVolume.Protocol == utils.ProtocolIscsi {
+		if multipathPortals != "" {
+			volumeContext[multipathPortalsKey] = multipathPortals
+		}
+		for _, key := range fsOptionKeys {
+			if params[key] != "" {
+				volumeContext[key] = params[key]
+			}
+		}
+		if params[reclaimSpaceKey] != "" {
+			volumeContext[reclaimSpaceKey] = strconv.FormatBool(utils.StringToBoolean(params[reclaimSpaceKey]))
+		}
+		if utils.StringToBoolean(params[encryptedKey]) {
+			volumeContext[encryptedKey] = "true"
+		}
+	} else {
+		for _, key := range smbOptionKeys {
+			if params[key] != "" {
+				volumeContext[key] = params[key]
+			}
+		}
+		setSmbVolumeContext(volumeContext, smbOpts)
+		if volumeUserName != "" {
+			volumeContext[smbVolumeUserKey] = volumeUserName
+		}
+		if k8sVolume.Share.Encryption != webapi.ShareEncryptionNone {
+			// also set for the clones of encrypted shares, the node unlocks the share before staging
+			volumeContext[encryptedKey] = "true"
+		}
+	}
+
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      k8sVolume.VolumeId,
 			CapacityBytes: k8sVolume.SizeInBytes,
 			ContentSource: volContentSrc,
-			VolumeContext: map[string]string{
-				"dsm":                  k8sVolume.DsmIp,
-				"protocol":             k8sVolume.Protocol,
-				"source":               k8sVolume.Source,
-				"is_thin_provisioning": strconv.FormatBool(isThin),
-			},
+			VolumeContext: volumeContext,
 		},
 	}, nil
 }
 
+// enableSMBEncryption makes the share of a sealed SMB volume refuse the clients which don't encrypt the traffic,
+// the share is only updated if the encryption isn't required yet
+func enableSMBEncryption(dsm *webapi.DSM, shareName string) error {
+	shareInfo, err := dsm.ShareGet(shareName)
+	if err != nil {
+		return fmt.Errorf("Failed to get share [%s], err: %v", shareName, err)
+	}
+	if shareInfo.SmbEncryption {
+		return nil
+	}
+
+	log.Infof("[%s] Enable SMB encryption of share [%s]", dsm.Ip, shareInfo.Name)
+	if err := dsm.SetShareSmbEncryption(shareInfo, true); err != nil {
+		return fmt.Errorf("Failed to enable SMB encryption of share [%s], err: %v", shareInfo.Name, err)
+	}
+	return nil
+}
+
+// grantSMBPrincipals grants the AD users and groups read-write permission of the share, which is mounted with Kerberos
+func (cs *controllerServer) grantSMBPrincipals(ctx context.Context, k8sVolume *models.K8sVolumeRespSpec, principals map[string][]string) error {
+	for _, userGroupType := range []string{models.UserGroupTypeDomainUser, models.UserGroupTypeDomainGroup} {
+		if len(principals[userGroupType]) == 0 {
+			continue
+		}
+
+		dsm, err := cs.dsmService.WithContext(ctx).GetDsm(k8sVolume.DsmIp)
+		if err != nil {
+			return status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s]", k8sVolume.DsmIp))
+		}
+
+		permissions := []*webapi.SharePermission{}
+		for _, name := range principals[userGroupType] {
+			permissions = append(permissions, &webapi.SharePermission{Name: name, IsWritable: true})
+		}
+
+		spec := webapi.SharePermissionSetSpec{
+			Name:          k8sVolume.Share.Name,
+			UserGroupType: userGroupType,
+			Permissions:   permissions,
+		}
+		if err := dsm.SharePermissionSet(spec); err != nil {
+			return status.Errorf(codes.Internal, fmt.Sprintf("Failed to grant %s %v permission of share [%s], err: %v",
+				userGroupType, principals[userGroupType], k8sVolume.Share.Name, err))
+		}
+	}
+
+	return nil
+}
+
+// createVolumeUser creates the DSM local user which is the only user allowed to access the share,
+// and writes its credentials to the node-stage secret named after the PV
+func (cs *controllerServer) createVolumeUser(ctx context.Context, k8sVolume *models.K8sVolumeRespSpec, pvName string, pvcName string, pvcNamespace string) (string, error) {
+	dsm, err := cs.dsmService.WithContext(ctx).GetDsm(k8sVolume.DsmIp)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s]", k8sVolume.DsmIp))
+	}
+
+	userName, password, err := ensureVolumeUser(dsm, k8sVolume.Share.Name)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, err.Error())
+	}
+
+	if err := grantVolumeUser(dsm, k8sVolume.Share.Name, userName); err != nil {
+		return "", status.Errorf(codes.Internal, fmt.Sprintf("Failed to grant user [%s] permission of share [%s], err: %v", userName, k8sVolume.Share.Name, err))
+	}
+
+	if err := writeVolumeUserSecret(ctx, pvName, pvcName, pvcNamespace, userName, password); err != nil {
+		return "", status.Errorf(codes.Internal, fmt.Sprintf("Failed to write secret of user [%s], err: %v", userName, err))
+	}
+
+	return userName, nil
+}
+
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeId := req.GetVolumeId()
 	if volumeId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "No volume id is provided")
 	}
 
-	if err := cs.dsmService.DeleteVolume(volumeId); err != nil {
+	if err := cs.dsmService.WithContext(ctx).DeleteVolume(volumeId); err != nil {
 		return nil, status.Errorf(codes.Internal,
 			fmt.Sprintf("Failed to DeleteVolume(%s), err: %v", volumeId, err))
 	}
@@ -268,7 +476,7 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "No volume capabilities are provided")
 	}
 
-	if cs.dsmService.GetVolume(volumeId) == nil {
+	if cs.dsmService.WithContext(ctx).GetVolume(volumeId) == nil {
 		return nil, status.Errorf(codes.NotFound, "Volume[%s] does not exist", volumeId)
 	}
 
@@ -293,7 +501,7 @@ func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolume
 	}
 
 	pagingSkip := ("" != startingToken)
-	infos := cs.dsmService.ListVolumes()
+	infos := cs.dsmService.WithContext(ctx).ListVolumes()
 
 	sort.Sort(models.ByVolumeId(infos))
 
@@ -342,7 +550,7 @@ func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolume
 func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
 	params := req.GetParameters()
 
-	volInfos, err := cs.dsmService.ListDsmVolumes(params["dsm"])
+	volInfos, err := cs.dsmService.WithContext(ctx).ListDsmVolumes(params["dsm"])
 
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "Failed to list dsm volumes")
@@ -388,13 +596,13 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return nil, status.Error(codes.InvalidArgument, "Snapshot name is empty.")
 	}
 
-	k8sVolume := cs.dsmService.GetVolume(srcVolId)
+	k8sVolume := cs.dsmService.WithContext(ctx).GetVolume(srcVolId)
 	if k8sVolume == nil {
 		return nil, status.Errorf(codes.NotFound, fmt.Sprintf("Can't find volume[%s].", srcVolId))
 	}
 
 	// idempotency
-	orgSnap := cs.dsmService.GetSnapshotByName(snapshotName)
+	orgSnap := cs.dsmService.WithContext(ctx).GetSnapshotByName(snapshotName)
 	if orgSnap != nil {
 		// already existed
 		if orgSnap.VolumeId != srcVolId {
@@ -432,7 +640,7 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		IsLocked:     utils.StringToBoolean(params["is_locked"]),
 	}
 
-	snapshot, err := cs.dsmService.CreateSnapshot(spec)
+	snapshot, err := cs.dsmService.WithContext(ctx).CreateSnapshot(spec)
 	if err != nil {
 		log.Errorf("Failed to CreateSnapshot, snapshotName: %s, srcVolId: %s, err: %v", snapshotName, srcVolId, err)
 		return nil, err
@@ -456,7 +664,7 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		return nil, status.Error(codes.InvalidArgument, "Snapshot id is empty.")
 	}
 
-	err := cs.dsmService.DeleteSnapshot(snapshotId)
+	err := cs.dsmService.WithContext(ctx).DeleteSnapshot(snapshotId)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to DeleteSnapshot(%s), err: %v", snapshotId, err))
 	}
@@ -481,9 +689,9 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 	var snapshots []*models.K8sSnapshotRespSpec
 
 	if srcVolId != "" {
-		snapshots = cs.dsmService.ListSnapshots(srcVolId)
+		snapshots = cs.dsmService.WithContext(ctx).ListSnapshots(srcVolId)
 	} else {
-		snapshots = cs.dsmService.ListAllSnapshots()
+		snapshots = cs.dsmService.WithContext(ctx).ListAllSnapshots()
 	}
 
 	sort.Sort(models.BySnapshotAndParentUuid(snapshots))
@@ -543,7 +751,7 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 			"InvalidArgument: Please check CapacityRange[%v]", capRange)
 	}
 
-	k8sVolume, err := cs.dsmService.ExpandVolume(volumeId, sizeInByte)
+	k8sVolume, err := cs.dsmService.WithContext(ctx).ExpandVolume(volumeId, sizeInByte)
 	if err != nil {
 		return nil, err
 	}
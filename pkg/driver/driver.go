@@ -17,6 +17,8 @@ limitations under the License.
 package driver
 
 import (
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	log "github.com/sirupsen/logrus"
 	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
@@ -31,6 +33,33 @@ const (
 var (
 	MultipathEnabled = true
 	supportedProtocolList = []string{utils.ProtocolIscsi, utils.ProtocolSmb}
+
+	// Node options
+	StagingRecordDir     = "/var/lib/kubelet/plugins/" + DriverName + "/staging"
+	SessionCheckInterval = 30 * time.Second // 0 to disable the iSCSI session supervisor
+	ReclaimInterval      = 24 * time.Hour   // 0 to disable fstrim of thin volumes
+	ReclaimJitter        = 1 * time.Hour
+	ReclaimConcurrency   = 1
+	Krb5CacheDir         = "/var/lib/kubelet/plugins/" + DriverName + "/krb5"
+	SmbGrantsNamespace   = "synology-csi" // namespace of the ConfigMaps tracking the SMB permissions granted by the nodes
+	SmbAllowUnsealed     = false // allow smb_seal=false, otherwise every SMB share requires SMB3 encryption
+	EphemeralStagingDir  = "/var/lib/kubelet/plugins/" + DriverName + "/ephemeral"
+	EphemeralGCInterval  = 10 * time.Minute // 0 to disable the garbage collection of orphaned ephemeral volumes
+	EphemeralMaxSize     = "10Gi"           // the largest size attribute of an ephemeral volume, 0 for no limit
+	EphemeralDsms        = []string{}       // the dsm attributes allowed, the volumes are created on the default DSM if empty
+	EphemeralLocations   = []string{}       // the location attributes allowed, the default location is used if empty
+	MaxVolumesPerNode    = int64(0)         // 0 for no limit
+	DsmMaxTargets        = 128              // iSCSI targets of each DSM, reported in the metrics
+	InitiatorNameFile    = "/host/etc/iscsi/initiatorname.iscsi" // the host root is mounted on /host of the node plugin
+	PreflightEnabled     = false                                 // only the node plugin checks the node prerequisites
+	PreflightSkip        = []string{}
+	PreflightInterval    = 1 * time.Minute // 0 to only check at startup
+	DsmPingInterval      = 30 * time.Second // 0 to disable, then Probe only checks if any DSM is added
+	DsmHealthProbe       = false            // only the controller plugin reports the DSM pings in Probe
+	DsmMaxLuns           = 256
+	DsmMaxShares         = 256
+	MetricsAddress       = "" // e.g. ":9090", empty to disable the /metrics endpoint
+	MetricsDsmStats      = true
 )
 
 type IDriver interface {
@@ -41,6 +70,8 @@ type Driver struct {
 	// *csicommon.CSIDriver
 	name                string
 	nodeID              string
+	preflight           *preflightChecker
+	dsmHealth           *dsmHealthChecker
 	version             string
 	endpoint            string
 	fsGroupChangePolicy string
@@ -82,7 +113,8 @@ func NewControllerAndNodeDriver(nodeID string, endpoint string, fsGroupChangePol
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
-		// csi.NodeServiceCapability_RPC_GET_VOLUME_STATS, //TODO
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	})
 
 	log.Infof("New driver created: name=%s, nodeID=%s, version=%s, endpoint=%s fsGroupChangePolicy=%s", d.name, d.nodeID, d.version, d.endpoint, d.fsGroupChangePolicy)
@@ -93,8 +125,39 @@ func NewControllerAndNodeDriver(nodeID string, endpoint string, fsGroupChangePol
 // TODO: func NewControllerDriver() {}
 
 func (d *Driver) Activate() {
+	if PreflightEnabled {
+		d.preflight = newPreflightChecker(PreflightInterval)
+		if PreflightInterval > 0 {
+			go d.preflight.Run(make(chan struct{}))
+		}
+	}
+
+	d.dsmHealth = newDsmHealthChecker(d.DsmService, DsmPingInterval)
+	if DsmPingInterval > 0 {
+		go d.dsmHealth.Run(make(chan struct{}))
+	}
+
+	if MetricsAddress != "" {
+		go serveMetrics(d.DsmService, d.dsmHealth)
+	}
+
+	ns := NewNodeServer(d)
+	ns.recoverStagedVolumes()
+
+	if SessionCheckInterval > 0 {
+		go ns.supervisor.Run(make(chan struct{}))
+	}
+
+	if ReclaimInterval > 0 {
+		go ns.reclaimer.Run(make(chan struct{}))
+	}
+
+	if EphemeralGCInterval > 0 {
+		go ns.runEphemeralCollector(EphemeralGCInterval, make(chan struct{}))
+	}
+
 	go func() {
-		RunControllerandNodePublishServer(d.endpoint, d, NewControllerServer(d), NewNodeServer(d))
+		RunControllerandNodePublishServer(d.endpoint, d, NewControllerServer(d), ns)
 	}()
 }
 
@@ -0,0 +1,126 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
+)
+
+// dsmHealthChecker pings the DSMs periodically and caches the results, so the Probe of liveness
+// and readiness checks never sends requests to the DSMs
+type dsmHealthChecker struct {
+	dsmService interfaces.IDsmService
+	interval   time.Duration
+
+	mu        sync.RWMutex
+	errs      map[string]error // the last ping error of each DSM, nil if healthy
+	lastCheck time.Time
+}
+
+func newDsmHealthChecker(dsmService interfaces.IDsmService, interval time.Duration) *dsmHealthChecker {
+	return &dsmHealthChecker{
+		dsmService: dsmService,
+		interval:   interval,
+		errs:       make(map[string]error),
+	}
+}
+
+func (c *dsmHealthChecker) Run(stopCh <-chan struct{}) {
+	log.Infof("DSM health checker started, ping interval: %v", c.interval)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.check()
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			log.Info("DSM health checker stopped")
+			return
+		}
+	}
+}
+
+// DsmInfoGet is a lightweight request, which also re-logins the expired session
+func (c *dsmHealthChecker) check() {
+	errs := make(map[string]error)
+	for _, dsm := range c.dsmService.ListDsms() {
+		_, err := dsm.DsmInfoGet()
+		if err != nil {
+			log.Errorf("Failed to ping DSM [%s]: %v", dsm.Ip, err)
+		}
+		errs[dsm.Ip] = err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ip, err := range errs {
+		if err == nil && c.errs[ip] != nil {
+			log.Infof("DSM [%s] is reachable again", ip)
+		}
+	}
+	c.errs = errs
+	c.lastCheck = time.Now()
+}
+
+// Results returns the last ping error of each DSM, nil if healthy
+func (c *dsmHealthChecker) Results() map[string]error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	results := make(map[string]error)
+	for ip, err := range c.errs {
+		results[ip] = err
+	}
+	return results
+}
+
+// Err returns nil if any DSM is healthy by the last ping
+func (c *dsmHealthChecker) Err() error {
+	if c.dsmService.GetDsmsCount() == 0 {
+		return fmt.Errorf("No DSM is added, check the client info and the DSM logins")
+	}
+	if c.interval <= 0 {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.lastCheck.IsZero() {
+		return fmt.Errorf("DSMs are not checked yet")
+	}
+
+	failed := []string{}
+	for ip, err := range c.errs {
+		if err == nil {
+			return nil
+		}
+		failed = append(failed, fmt.Sprintf("[%s]: %v", ip, err))
+	}
+	return fmt.Errorf("No DSM is healthy at %s, %s", c.lastCheck.Format(time.RFC3339), strings.Join(failed, "; "))
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+const (
+	ephemeralKey     = "csi.storage.k8s.io/ephemeral" // set by kubelet for the inline volumes of pods
+	ephemeralSizeKey = "size"                         // volume attribute, e.g. "100Gi"
+
+	defaultEphemeralSize = 1 * utils.UNIT_GB
+)
+
+var ephemeralLunTypes = []string{models.LunTypeThin, models.LunTypeAdv, models.LunTypeBlun, models.LunTypeBlunThick, models.LunTypeFile}
+
+func isEphemeralVolume(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralKey] == "true"
+}
+
+func shortHash(s string, length int) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:length]
+}
+
+// the owner tag in the description of the backing LUN or share, e.g. "(Do not change) ephemeral 1a2b3c4d/0123456789abcdef",
+// which tells the node and the volume handle by hashes, as the description is up to 64 characters
+func ephemeralOwnerPrefix(nodeId string) string {
+	return fmt.Sprintf("%s %s/", models.EphemeralDescPrefix, shortHash(nodeId, 8))
+}
+
+func ephemeralOwnerTag(nodeId string, volumeId string) string {
+	return ephemeralOwnerPrefix(nodeId) + shortHash(volumeId, 16)
+}
+
+// the inline volumes are locked by the hash of their owner tag, so the collector, which only knows the hash, takes
+// the same locks as the publish and unpublish of the volumes
+func ephemeralLockKey(volumeId string) string {
+	return shortHash(volumeId, 16)
+}
+
+func getEphemeralVolumeSpec(nodeId string, volumeId string, attrs map[string]string) (*models.CreateK8sVolumeSpec, error) {
+	protocol := strings.ToLower(attrs["protocol"])
+	if protocol == "" {
+		protocol = utils.ProtocolDefault
+	} else if !isProtocolSupport(protocol) {
+		return nil, fmt.Errorf("Unsupported volume protocol: %s", protocol)
+	}
+
+	size := int64(defaultEphemeralSize)
+	if attrs[ephemeralSizeKey] != "" {
+		quantity, err := resource.ParseQuantity(attrs[ephemeralSizeKey])
+		if err != nil || quantity.Value() <= 0 {
+			return nil, fmt.Errorf("Invalid %s: %q", ephemeralSizeKey, attrs[ephemeralSizeKey])
+		}
+		size = quantity.Value()
+	}
+
+	// the attributes are given by anyone who can create a pod, so they are bounded by the driver options
+	maxSize, err := resource.ParseQuantity(EphemeralMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid max size of ephemeral volumes: %q", EphemeralMaxSize)
+	}
+	if maxSize.Value() > 0 && size > maxSize.Value() {
+		return nil, fmt.Errorf("%s %q exceeds the max size of ephemeral volumes: %s", ephemeralSizeKey, attrs[ephemeralSizeKey], EphemeralMaxSize)
+	}
+	if attrs["dsm"] != "" && !utils.SliceContains(EphemeralDsms, attrs["dsm"]) {
+		return nil, fmt.Errorf("dsm %q is not allowed for ephemeral volumes, allowed: %v", attrs["dsm"], EphemeralDsms)
+	}
+	if attrs["location"] != "" && !utils.SliceContains(EphemeralLocations, attrs["location"]) {
+		return nil, fmt.Errorf("location %q is not allowed for ephemeral volumes, allowed: %v", attrs["location"], EphemeralLocations)
+	}
+	if attrs["type"] != "" && !utils.SliceContains(ephemeralLunTypes, attrs["type"]) {
+		return nil, fmt.Errorf("Invalid type: %q, must be one of %v", attrs["type"], ephemeralLunTypes)
+	}
+
+	isThin := true
+	if attrs["thin_provisioning"] != "" {
+		isThin = utils.StringToBoolean(attrs["thin_provisioning"])
+	}
+
+	// the volume handle of an inline volume is too long for a share name
+	hash := shortHash(volumeId, 16)
+	tag := ephemeralOwnerTag(nodeId, volumeId)
+
+	return &models.CreateK8sVolumeSpec{
+		DsmIp:            attrs["dsm"],
+		K8sVolumeName:    volumeId,
+		LunName:          fmt.Sprintf("%s-eph-%s", models.LunPrefix, hash),
+		ShareName:        fmt.Sprintf("%s-eph-%s", models.SharePrefix, hash),
+		Location:         attrs["location"],
+		Size:             size,
+		Type:             attrs["type"],
+		ThinProvisioning: isThin,
+		TargetName:       fmt.Sprintf("%s-eph-%s", models.TargetPrefix, hash),
+		Protocol:         protocol,
+		LunDescription:   tag,
+		ShareDescription: tag,
+	}, nil
+}
+
+// nodePublishEphemeralVolume creates the backing LUN or share of an inline volume, then stages and publishes it
+func (ns *nodeServer) nodePublishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeId, targetPath := req.GetVolumeId(), req.GetTargetPath()
+	if volumeId == "" || targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "InvalidArgument: Please check volume ID and target path.")
+	}
+	if req.GetVolumeCapability() == nil || req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Ephemeral volumes only allow 'mount' access type")
+	}
+
+	attrs := req.GetVolumeContext()
+	spec, err := getEphemeralVolumeSpec(ns.Driver.nodeID, volumeId, attrs)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// validated here as there is no CreateVolume for the inline volumes
+	var smbOpts *smbOptions
+	if spec.Protocol == utils.ProtocolSmb {
+		smbOpts, err = parseSmbOptions(attrs)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := validateSmbMountFlags(req.GetVolumeCapability().GetMount().GetMountFlags(), smbOpts.Seal); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// not volumeLocks, which are taken again for the backing volume and may hash to the same lock
+	ns.ephemeralLocks.LockKey(ephemeralLockKey(volumeId))
+	defer ns.ephemeralLocks.UnlockKey(ephemeralLockKey(volumeId))
+
+	record, err := ns.ephemeralStore.Get(volumeId, targetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// saved before the backing volume is created, so the garbage collector never deletes a volume being published
+		record = &stagingRecord{
+			VolumeId:          volumeId,
+			Protocol:          spec.Protocol,
+			StagingTargetPath: targetPath,
+		}
+		if err := ns.ephemeralStore.Save(record); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to save ephemeral record: %v", err))
+		}
+	}
+
+	k8sVolume := ns.dsmService.WithContext(ctx).GetVolumeByName(spec.LunName, spec.ShareName)
+	if k8sVolume == nil {
+		log.Infof("Create backing volume [%s] of ephemeral volume[%s]", spec.LunName, volumeId)
+		k8sVolume, err = ns.dsmService.WithContext(ctx).CreateVolume(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	record.DsmIp = k8sVolume.DsmIp
+	record.BackingVolumeId = k8sVolume.VolumeId
+	record.BackingStagingPath = filepath.Join(EphemeralStagingDir, shortHash(volumeId, 16))
+	if err := ns.ephemeralStore.Save(record); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to save ephemeral record: %v", err))
+	}
+
+	volumeContext := map[string]string{
+		"dsm":                  k8sVolume.DsmIp,
+		"protocol":             k8sVolume.Protocol,
+		"source":               k8sVolume.Source,
+		"is_thin_provisioning": strconv.FormatBool(spec.ThinProvisioning),
+	}
+	for _, key := range append(append([]string{"multipath_portals", "reclaim_space"}, fsOptionKeys...), smbOptionKeys...) {
+		if attrs[key] != "" {
+			volumeContext[key] = attrs[key]
+		}
+	}
+	// the share encryption is enabled by NodeStageVolume
+	if smbOpts != nil {
+		setSmbVolumeContext(volumeContext, smbOpts)
+	}
+
+	// kubelet only creates the staging paths of the persistent volumes
+	if err := os.MkdirAll(record.BackingStagingPath, 0750); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          record.BackingVolumeId,
+		StagingTargetPath: record.BackingStagingPath,
+		VolumeCapability:  req.GetVolumeCapability(),
+		Secrets:           req.GetSecrets(),
+		VolumeContext:     volumeContext,
+	}); err != nil {
+		return nil, err
+	}
+
+	return ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          record.BackingVolumeId,
+		StagingTargetPath: record.BackingStagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  req.GetVolumeCapability(),
+		Readonly:          req.GetReadonly(),
+		VolumeContext:     volumeContext,
+	})
+}
+
+// nodeUnpublishEphemeralVolume unpublishes and unstages the inline volume, then deletes its backing LUN or share
+func (ns *nodeServer) nodeUnpublishEphemeralVolume(ctx context.Context, record *stagingRecord) (*csi.NodeUnpublishVolumeResponse, error) {
+	ns.ephemeralLocks.LockKey(ephemeralLockKey(record.VolumeId))
+	defer ns.ephemeralLocks.UnlockKey(ephemeralLockKey(record.VolumeId))
+
+	if err := ns.unmountTargetPath(ctx, record.StagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	if record.BackingVolumeId != "" {
+		if _, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          record.BackingVolumeId,
+			StagingTargetPath: record.BackingStagingPath,
+		}); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(record.BackingStagingPath); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to remove staging path of ephemeral volume[%s]: %v", record.VolumeId, err)
+		}
+
+		log.Infof("Delete backing volume [%s] of ephemeral volume[%s]", record.BackingVolumeId, record.VolumeId)
+		if err := ns.dsmService.WithContext(ctx).DeleteVolume(record.BackingVolumeId); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to delete backing volume [%s]: %v", record.BackingVolumeId, err))
+		}
+	}
+
+	if err := ns.ephemeralStore.Delete(record.VolumeId, record.StagingTargetPath); err != nil {
+		log.Errorf("Failed to delete ephemeral record of volume[%s]: %v", record.VolumeId, err)
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// collectEphemeralVolumes deletes the backing volumes owned by this node without an ephemeral record,
+// e.g. left by a node plugin crashed before NodeUnpublishVolume
+func (ns *nodeServer) collectEphemeralVolumes() {
+	// list the volumes before the records, whose records are saved before they are created
+	volumes := ns.dsmService.ListVolumes()
+
+	records, err := ns.ephemeralStore.List()
+	if err != nil {
+		log.Errorf("Failed to list ephemeral records: %v", err)
+		return
+	}
+
+	owned := ephemeralOwnedHashes(records)
+	prefix := ephemeralOwnerPrefix(ns.Driver.nodeID)
+	for _, volume := range volumes {
+		desc := volume.Lun.Description
+		if volume.Protocol == utils.ProtocolSmb {
+			desc = volume.Share.Desc
+		}
+		if !strings.HasPrefix(desc, prefix) || owned[strings.TrimPrefix(desc, prefix)] {
+			continue
+		}
+
+		ns.deleteOrphanedEphemeralVolume(volume.VolumeId, strings.TrimPrefix(desc, prefix))
+	}
+}
+
+func ephemeralOwnedHashes(records []*stagingRecord) map[string]bool {
+	owned := make(map[string]bool)
+	for _, record := range records {
+		owned[ephemeralLockKey(record.VolumeId)] = true
+	}
+	return owned
+}
+
+// deleteOrphanedEphemeralVolume deletes the backing volume under the lock of its inline volume, unless the inline
+// volume was published since the volumes were listed
+func (ns *nodeServer) deleteOrphanedEphemeralVolume(backingVolumeId string, hash string) {
+	ns.ephemeralLocks.LockKey(hash)
+	defer ns.ephemeralLocks.UnlockKey(hash)
+
+	records, err := ns.ephemeralStore.List()
+	if err != nil {
+		log.Errorf("Failed to list ephemeral records: %v", err)
+		return
+	}
+	if ephemeralOwnedHashes(records)[hash] {
+		return
+	}
+	// deleted meanwhile by the unpublish of the inline volume
+	if ns.dsmService.GetVolume(backingVolumeId) == nil {
+		return
+	}
+
+	log.Infof("Delete orphaned ephemeral volume [%s], owner: %s", backingVolumeId, hash)
+	if err := ns.dsmService.DeleteVolume(backingVolumeId); err != nil {
+		log.Errorf("Failed to delete orphaned ephemeral volume [%s]: %v", backingVolumeId, err)
+	}
+}
+
+func (ns *nodeServer) runEphemeralCollector(interval time.Duration, stopCh <-chan struct{}) {
+	log.Infof("Ephemeral volume collector started, interval: %v", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ns.collectEphemeralVolumes()
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			log.Info("Ephemeral volume collector stopped")
+			return
+		}
+	}
+}
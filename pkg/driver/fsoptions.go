@@ -0,0 +1,186 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameters of the iSCSI filesystems, passed to the node in VolumeContext
+const (
+	mkfsOptionsKey  = "mkfs_options"
+	mountOptionsKey = "mount_options"
+	fsBlockSizeKey  = "fs_block_size"
+	xfsReflinkKey   = "xfs_reflink"
+
+	defaultFsType = "ext4"
+)
+
+var fsOptionKeys = []string{mkfsOptionsKey, mountOptionsKey, fsBlockSizeKey, xfsReflinkKey}
+
+// the block sizes accepted by mkfs of each filesystem
+var fsBlockSizes = map[string][]int{
+	"ext4":  {1024, 2048, 4096, 65536},
+	"xfs":   {512, 1024, 2048, 4096, 8192, 16384, 32768, 65536},
+	"btrfs": {4096, 16384, 65536},
+}
+
+// the mount options only understood by one of the filesystems, e.g. "sunit" of xfs
+var fsSpecificMountOptions = map[string][]string{
+	"ext4":  {"stripe", "data", "journal_checksum", "journal_async_commit", "commit", "barrier", "nodelalloc", "dioread_nolock"},
+	"xfs":   {"sunit", "swidth", "logbsize", "logbufs", "allocsize", "inode64", "inode32", "nouuid", "largeio"},
+	"btrfs": {"compress", "compress-force", "subvol", "subvolid", "space_cache", "ssd", "nossd", "autodefrag"},
+}
+
+type fsOptions struct {
+	FsType       string
+	MkfsOptions  []string
+	MountOptions []string
+	BlockSize    int
+	XfsReflink   *bool
+}
+
+// parseFsOptions parses and validates the filesystem options in the parameters against the fsType
+func parseFsOptions(fsType string, params map[string]string) (*fsOptions, error) {
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	opts := &fsOptions{FsType: fsType}
+
+	blockSizes, supported := fsBlockSizes[fsType]
+	for _, key := range fsOptionKeys {
+		if params[key] != "" && !supported {
+			return nil, fmt.Errorf("%s is not supported by fsType %s, only ext4, xfs and btrfs", key, fsType)
+		}
+	}
+
+	opts.MkfsOptions = strings.Fields(params[mkfsOptionsKey])
+
+	if params[mountOptionsKey] != "" {
+		for _, option := range strings.Split(params[mountOptionsKey], ",") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				return nil, fmt.Errorf("Invalid %s: %q", mountOptionsKey, params[mountOptionsKey])
+			}
+			if other := getMountOptionFs(option); other != "" && other != fsType {
+				return nil, fmt.Errorf("Mount option %q is for %s, not %s", option, other, fsType)
+			}
+			opts.MountOptions = append(opts.MountOptions, option)
+		}
+	}
+
+	if params[fsBlockSizeKey] != "" {
+		blockSize, err := strconv.Atoi(params[fsBlockSizeKey])
+		if err != nil || !containsInt(blockSizes, blockSize) {
+			return nil, fmt.Errorf("Invalid %s: %q, %s supports %v", fsBlockSizeKey, params[fsBlockSizeKey], fsType, blockSizes)
+		}
+		opts.BlockSize = blockSize
+	}
+
+	if params[xfsReflinkKey] != "" {
+		if fsType != "xfs" {
+			return nil, fmt.Errorf("%s is only supported by xfs, not %s", xfsReflinkKey, fsType)
+		}
+		reflink, err := strconv.ParseBool(params[xfsReflinkKey])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %q", xfsReflinkKey, params[xfsReflinkKey])
+		}
+		opts.XfsReflink = &reflink
+	}
+
+	return opts, nil
+}
+
+func getMountOptionFs(option string) string {
+	name := strings.SplitN(option, "=", 2)[0]
+	for fsType, names := range fsSpecificMountOptions {
+		for _, n := range names {
+			if n == name {
+				return fsType
+			}
+		}
+	}
+	return ""
+}
+
+func containsInt(items []int, i int) bool {
+	for _, item := range items {
+		if item == i {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatOptions returns the mkfs arguments, nodiscard is added for thin LUNs of ext4 and btrfs to skip discarding the whole device
+func (opts *fsOptions) FormatOptions(isThin bool) []string {
+	formatOptions := []string{}
+
+	switch opts.FsType {
+	case "ext4":
+		if opts.BlockSize != 0 {
+			formatOptions = append(formatOptions, "-b", strconv.Itoa(opts.BlockSize))
+		}
+	case "xfs":
+		if opts.BlockSize != 0 {
+			formatOptions = append(formatOptions, "-b", fmt.Sprintf("size=%d", opts.BlockSize))
+		}
+		if opts.XfsReflink != nil {
+			formatOptions = append(formatOptions, "-m", fmt.Sprintf("reflink=%d", boolToInt(*opts.XfsReflink)))
+		}
+	case "btrfs":
+		if opts.BlockSize != 0 {
+			formatOptions = append(formatOptions, "--sectorsize", strconv.Itoa(opts.BlockSize))
+		}
+	}
+
+	mkfsOptions := append([]string{}, opts.MkfsOptions...)
+	if isThin {
+		switch opts.FsType {
+		case "ext4":
+			mkfsOptions = appendExt4ExtendedOption(mkfsOptions, "nodiscard")
+		case "btrfs":
+			mkfsOptions = append(mkfsOptions, "--nodiscard")
+		}
+	}
+
+	return append(formatOptions, mkfsOptions...)
+}
+
+// mke2fs only takes the last -E, so merge the option into the one given by the user, e.g. "-E stride=16,nodiscard"
+func appendExt4ExtendedOption(mkfsOptions []string, option string) []string {
+	for i, arg := range mkfsOptions {
+		if arg == "-E" && i+1 < len(mkfsOptions) {
+			mkfsOptions[i+1] += "," + option
+			return mkfsOptions
+		}
+		if strings.HasPrefix(arg, "-E") && len(arg) > 2 {
+			mkfsOptions[i] += "," + option
+			return mkfsOptions
+		}
+	}
+	return append(mkfsOptions, "-E", option)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
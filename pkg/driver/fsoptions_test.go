@@ -0,0 +1,156 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseFsOptions(t *testing.T) {
+	reflink := true
+	type args struct {
+		fsType string
+		params map[string]string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *fsOptions
+		wantErr bool
+	}{
+		{
+			name: "default fsType",
+			args: args{params: map[string]string{}},
+			want: &fsOptions{FsType: "ext4", MkfsOptions: []string{}},
+		},
+		{
+			name: "ext4",
+			args: args{fsType: "ext4", params: map[string]string{
+				mkfsOptionsKey:  "-E stride=16 -m 1",
+				mountOptionsKey: "noatime, data=ordered",
+				fsBlockSizeKey:  "4096",
+			}},
+			want: &fsOptions{
+				FsType:       "ext4",
+				MkfsOptions:  []string{"-E", "stride=16", "-m", "1"},
+				MountOptions: []string{"noatime", "data=ordered"},
+				BlockSize:    4096,
+			},
+		},
+		{
+			name: "xfs reflink",
+			args: args{fsType: "xfs", params: map[string]string{xfsReflinkKey: "true", fsBlockSizeKey: "512"}},
+			want: &fsOptions{FsType: "xfs", MkfsOptions: []string{}, BlockSize: 512, XfsReflink: &reflink},
+		},
+		{
+			name:    "unsupported fsType",
+			args:    args{fsType: "ext3", params: map[string]string{mkfsOptionsKey: "-m 1"}},
+			wantErr: true,
+		},
+		{
+			name:    "mount option of another fsType",
+			args:    args{fsType: "ext4", params: map[string]string{mountOptionsKey: "inode64"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty mount option",
+			args:    args{fsType: "ext4", params: map[string]string{mountOptionsKey: "noatime,,nodev"}},
+			wantErr: true,
+		},
+		{
+			name:    "block size of another fsType",
+			args:    args{fsType: "btrfs", params: map[string]string{fsBlockSizeKey: "1024"}},
+			wantErr: true,
+		},
+		{
+			name:    "xfs_reflink of ext4",
+			args:    args{fsType: "ext4", params: map[string]string{xfsReflinkKey: "true"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid xfs_reflink",
+			args:    args{fsType: "xfs", params: map[string]string{xfsReflinkKey: "maybe"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFsOptions(tt.args.fsType, tt.args.params)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFsOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseFsOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fsOptions_FormatOptions(t *testing.T) {
+	reflink := false
+	tests := []struct {
+		name   string
+		opts   fsOptions
+		isThin bool
+		want   []string
+	}{
+		{
+			name: "ext4 thick",
+			opts: fsOptions{FsType: "ext4", BlockSize: 4096, MkfsOptions: []string{"-m", "1"}},
+			want: []string{"-b", "4096", "-m", "1"},
+		},
+		{
+			name:   "ext4 thin",
+			opts:   fsOptions{FsType: "ext4"},
+			isThin: true,
+			want:   []string{"-E", "nodiscard"},
+		},
+		{
+			name:   "ext4 thin with extended options",
+			opts:   fsOptions{FsType: "ext4", MkfsOptions: []string{"-E", "stride=16"}},
+			isThin: true,
+			want:   []string{"-E", "stride=16,nodiscard"},
+		},
+		{
+			name:   "xfs thin",
+			opts:   fsOptions{FsType: "xfs", BlockSize: 4096, XfsReflink: &reflink},
+			isThin: true,
+			want:   []string{"-b", "size=4096", "-m", "reflink=0"},
+		},
+		{
+			name:   "btrfs thin",
+			opts:   fsOptions{FsType: "btrfs", BlockSize: 16384},
+			isThin: true,
+			want:   []string{"--sectorsize", "16384", "--nodiscard"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.FormatOptions(tt.isThin); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FormatOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_appendExt4ExtendedOption(t *testing.T) {
+	tests := []struct {
+		name        string
+		mkfsOptions []string
+		option      string
+		want        []string
+	}{
+		{name: "no -E", mkfsOptions: []string{"-m", "1"}, option: "nodiscard", want: []string{"-m", "1", "-E", "nodiscard"}},
+		{name: "separate -E", mkfsOptions: []string{"-E", "stride=16"}, option: "nodiscard", want: []string{"-E", "stride=16,nodiscard"}},
+		{name: "joined -E", mkfsOptions: []string{"-Estride=16"}, option: "nodiscard", want: []string{"-Estride=16,nodiscard"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendExt4ExtendedOption(tt.mkfsOptions, tt.option); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("appendExt4ExtendedOption() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
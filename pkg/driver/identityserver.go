@@ -21,6 +21,8 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type identityServer struct {
@@ -43,7 +45,23 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	// a node missing the prerequisites can't stage any volume, report it before the workloads land on it
+	if ids.Driver.preflight != nil {
+		if err := ids.Driver.preflight.Err(); err != nil {
+			log.Warnf("Probe: not ready, %v", err)
+			return &csi.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
+		}
+	}
+
+	// the node plugins keep serving the staged volumes without DSM, so only the controller is gated on the DSM pings
+	if DsmHealthProbe && ids.Driver.dsmHealth != nil {
+		if err := ids.Driver.dsmHealth.Err(); err != nil {
+			log.Warnf("Probe: not ready, %v", err)
+			return &csi.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
+		}
+	}
+
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
@@ -0,0 +1,106 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
+)
+
+// fakeDsmService only implements the methods used by the tests, the others panic
+type fakeDsmService struct {
+	interfaces.IDsmService
+	dsmsCount int
+}
+
+func (s *fakeDsmService) GetDsmsCount() int {
+	return s.dsmsCount
+}
+
+func Test_identityServer_Probe(t *testing.T) {
+	defer func(enabled bool) { DsmHealthProbe = enabled }(DsmHealthProbe)
+
+	healthy := &dsmHealthChecker{
+		dsmService: &fakeDsmService{dsmsCount: 2},
+		interval:   time.Minute,
+		errs:       map[string]error{"10.0.0.1": errors.New("timeout"), "10.0.0.2": nil},
+		lastCheck:  time.Now(),
+	}
+	unhealthy := &dsmHealthChecker{
+		dsmService: &fakeDsmService{dsmsCount: 1},
+		interval:   time.Minute,
+		errs:       map[string]error{"10.0.0.1": errors.New("timeout")},
+		lastCheck:  time.Now(),
+	}
+	noDsm := &dsmHealthChecker{
+		dsmService: &fakeDsmService{},
+		interval:   0,
+	}
+
+	tests := []struct {
+		name        string
+		healthProbe bool
+		preflight   *preflightChecker
+		dsmHealth   *dsmHealthChecker
+		want        bool
+	}{
+		{
+			name:        "one DSM healthy",
+			healthProbe: true,
+			dsmHealth:   healthy,
+			want:        true,
+		},
+		{
+			name:        "no DSM healthy",
+			healthProbe: true,
+			dsmHealth:   unhealthy,
+			want:        false,
+		},
+		{
+			name:        "no DSM added",
+			healthProbe: true,
+			dsmHealth:   noDsm,
+			want:        false,
+		},
+		{
+			name:        "no DSM healthy on a node plugin",
+			healthProbe: false,
+			dsmHealth:   unhealthy,
+			want:        true,
+		},
+		{
+			name:        "preflight failed",
+			healthProbe: false,
+			preflight:   &preflightChecker{err: errors.New("iscsiadm not found")},
+			dsmHealth:   healthy,
+			want:        false,
+		},
+		{
+			name:        "preflight passed",
+			healthProbe: true,
+			preflight:   &preflightChecker{},
+			dsmHealth:   healthy,
+			want:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			DsmHealthProbe = tt.healthProbe
+			ids := &identityServer{Driver: &Driver{preflight: tt.preflight, dsmHealth: tt.dsmHealth}}
+
+			resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+			if err != nil {
+				t.Fatalf("Probe() error = %v", err)
+			}
+			if got := resp.GetReady().GetValue(); got != tt.want {
+				t.Errorf("Probe() ready = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -19,13 +19,20 @@ limitations under the License.
 package driver
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	utilexec "k8s.io/utils/exec"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
 )
 
 type initiatorDriver struct {
@@ -123,13 +130,15 @@ func iscsiadm_login(iqn, portal string) error {
 	return nil
 }
 
-func iscsiadm_logout(iqn string) error {
+func iscsiadm_logout(iqn string, portal string) error {
 	cmd := iscsiadm(
 		"-m", "node",
 		"--targetname", iqn,
+		"--portal", portal,
 		"--logout")
-	if _, err := cmd.CombinedOutput(); err != nil {
-		return err
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s (%v)", string(out), err)
 	}
 	return nil
 }
@@ -146,8 +155,10 @@ func iscsiadm_rescan(iqn string) error {
 }
 
 func hasSession(targetIqn string, portal string) bool {
-	sessions := iscsiadm_session()
+	return findSession(iscsiadm_session(), targetIqn, portal)
+}
 
+func findSession(sessions []iscsiSession, targetIqn string, portal string) bool {
 	for _, s := range sessions {
 		if targetIqn == s.Iqn && (portal == s.Portal || portal == "") {
 			return true
@@ -169,7 +180,10 @@ func listSessionsByIqn(targetIqn string) (matchedSessions []iscsiSession) {
 	return matchedSessions
 }
 
-func (d *initiatorDriver) login(targetIqn string, portal string) error{
+func (d *initiatorDriver) login(ctx context.Context, targetIqn string, portal string) (err error) {
+	_, span := tracing.StartChild(ctx, "iscsiadm login", attribute.String("iscsi.target", targetIqn), attribute.String("iscsi.portal", portal))
+	defer func() { tracing.End(span, err) }()
+
 	if (hasSession(targetIqn, portal)) {
 		log.Infof("Session[%s] already exists.", targetIqn)
 		return nil
@@ -190,14 +204,16 @@ func (d *initiatorDriver) login(targetIqn string, portal string) error{
 	return nil
 }
 
-func (d *initiatorDriver) logout(targetIqn string, ip string) error{
-	if (!hasSession(targetIqn, "")) {
-		log.Infof("Session[%s] doesn't exist.", targetIqn)
+func (d *initiatorDriver) logout(ctx context.Context, targetIqn string, portal string) (err error) {
+	_, span := tracing.StartChild(ctx, "iscsiadm logout", attribute.String("iscsi.target", targetIqn), attribute.String("iscsi.portal", portal))
+	defer func() { tracing.End(span, err) }()
+
+	if (!hasSession(targetIqn, portal)) {
+		log.Infof("Session[%s] on portal [%s] doesn't exist.", targetIqn, portal)
 		return nil
 	}
 
-	portal := fmt.Sprintf("%s:%d", ip, ISCSIPort)
-	if err := iscsiadm_logout(targetIqn); err != nil {
+	if err := iscsiadm_logout(targetIqn, portal); err != nil {
 		log.Errorf("Failed in logout of the target.\nTarget [%s], Portal [%s], Err[%v]",
 			targetIqn, portal, err)
 		return err
@@ -208,7 +224,29 @@ func (d *initiatorDriver) logout(targetIqn string, ip string) error{
 	return nil
 }
 
-func (d *initiatorDriver) rescan(targetIqn string) error{
+// removes the SCSI device of a LUN whose target session is kept for other LUNs
+func removeSCSIDevice(devPath string) error {
+	realPath, err := filepath.EvalSymlinks(devPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	deletePath := filepath.Join("/sys/block", filepath.Base(realPath), "device", "delete")
+	if err := ioutil.WriteFile(deletePath, []byte("1"), 0200); err != nil {
+		return fmt.Errorf("Failed to delete SCSI device [%s]: %v", realPath, err)
+	}
+
+	log.Infof("Removed SCSI device [%s] of [%s].", realPath, devPath)
+	return nil
+}
+
+func (d *initiatorDriver) rescan(ctx context.Context, targetIqn string) (err error) {
+	_, span := tracing.StartChild(ctx, "iscsiadm rescan", attribute.String("iscsi.target", targetIqn))
+	defer func() { tracing.End(span, err) }()
+
 	if (!hasSession(targetIqn, "")) {
 		msg := fmt.Sprintf("Session[%s] doesn't exist.", targetIqn)
 		log.Error(msg)
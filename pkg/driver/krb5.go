@@ -0,0 +1,90 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// keys of the node-stage secret for sec=krb5 mounts
+	krb5PrincipalKey = "krb5_principal" // e.g. "csi-node@EXAMPLE.COM"
+	krb5KeytabKey    = "krb5_keytab"    // content of the keytab file of the principal
+
+	kinitTimeout = 30 * time.Second
+)
+
+// the credential cache of the principal, which is refreshed by kinit from the keytab, or maintained out of the
+// driver, e.g. by a ticket renewer mapping the service accounts to principals
+func krb5CcachePath(principal string) string {
+	sum := sha256.Sum256([]byte(principal))
+	return filepath.Join(Krb5CacheDir, "krb5cc_"+hex.EncodeToString(sum[:8]))
+}
+
+// getKrb5Ccache returns the credential cache holding a valid ticket of the principal
+func getKrb5Ccache(principal string, keytab string) (string, error) {
+	if principal == "" {
+		return "", fmt.Errorf("Missing %s in the node-stage secret", krb5PrincipalKey)
+	}
+
+	ccache := krb5CcachePath(principal)
+	if keytab == "" {
+		if _, err := os.Stat(ccache); err != nil {
+			return "", fmt.Errorf("No %s in the node-stage secret and no credential cache of %s: %v", krb5KeytabKey, principal, err)
+		}
+		return ccache, nil
+	}
+
+	if err := os.MkdirAll(Krb5CacheDir, 0700); err != nil {
+		return "", err
+	}
+
+	keytabPath := ccache + ".keytab"
+	if err := ioutil.WriteFile(keytabPath, []byte(keytab), 0600); err != nil {
+		return "", fmt.Errorf("Failed to write keytab of %s: %v", principal, err)
+	}
+	defer os.Remove(keytabPath)
+
+	if _, err := execWithTimeout("kinit", []string{"-k", "-t", keytabPath, "-c", "FILE:" + ccache, principal}, kinitTimeout); err != nil {
+		return "", fmt.Errorf("kinit %s failed: %v", principal, err)
+	}
+	log.Infof("Got Kerberos ticket of %s", principal)
+
+	return ccache, nil
+}
+
+// mountCIFSWithCcache mounts the share with sec=krb5, cifs.upcall looks up the ticket in the KRB5CCNAME of the mount process
+func mountCIFSWithCcache(source string, target string, options []string, ccache string) error {
+	executor := utilexec.New()
+	cmd := executor.Command("mount", "-t", "cifs", "-o", strings.Join(options, ","), source, target)
+	cmd.SetEnv(append(os.Environ(), "KRB5CCNAME=FILE:"+ccache))
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mount failed: %v, output: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	encryptedKey            = "encrypted"
+	encryptionPassphraseKey = "encryption_passphrase" // key of the node-stage secret
+)
+
+var invalidMapperNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+func cryptsetup(passphrase string, args ...string) ([]byte, error) {
+	executor := utilexec.New()
+	cmd := executor.Command("cryptsetup", args...)
+	if passphrase != "" {
+		cmd.SetStdin(strings.NewReader(passphrase))
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("cryptsetup %s failed: %s (%v)", args[0], strings.TrimSpace(string(out)), err)
+	}
+	return out, nil
+}
+
+// luksMapperName returns the device mapper name of the volume, e.g. "luks-k8s-csi-pvc-xxx-1a2b3c4d",
+// the hash keeps the names of the LUNs with the same name on different DSMs apart
+func luksMapperName(volumeId string) string {
+	sum := sha256.Sum256([]byte(volumeId))
+	name := invalidMapperNameChars.ReplaceAllString(filepath.Base(volumeId), "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return fmt.Sprintf("luks-%s-%s", name, hex.EncodeToString(sum[:4]))
+}
+
+func luksMapperPath(name string) string {
+	return filepath.Join("/dev/mapper", name)
+}
+
+func isLuks(devPath string) bool {
+	_, err := cryptsetup("", "isLuks", devPath)
+	return err == nil
+}
+
+func isLuksOpen(name string) bool {
+	exists, _ := mount.PathExists(luksMapperPath(name))
+	return exists
+}
+
+func luksFormat(devPath string, passphrase string) error {
+	_, err := cryptsetup(passphrase, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", devPath)
+	return err
+}
+
+// the volume key is kept in the dm-crypt table instead of the kernel keyring, so the device can be
+// resized without the passphrase. Discards are passed through for the volumes reclaimed by fstrim.
+func luksOpen(devPath string, name string, passphrase string, allowDiscards bool) error {
+	args := []string{"luksOpen", "--disable-keyring", "--key-file", "-"}
+	if allowDiscards {
+		args = append(args, "--allow-discards")
+	}
+	_, err := cryptsetup(passphrase, append(args, devPath, name)...)
+	return err
+}
+
+func luksClose(name string) error {
+	if !isLuksOpen(name) {
+		return nil
+	}
+	_, err := cryptsetup("", "luksClose", name)
+	return err
+}
+
+func luksResize(name string) error {
+	_, err := cryptsetup("", "resize", name)
+	return err
+}
+
+// openEncryptedDevice formats the device with LUKS on the first stage, and opens it as /dev/mapper/<name>
+func (ns *nodeServer) openEncryptedDevice(devPath string, name string, passphrase string, allowDiscards bool) (string, error) {
+	if isLuksOpen(name) {
+		return luksMapperPath(name), nil
+	}
+
+	if passphrase == "" {
+		return "", fmt.Errorf("Missing %s in the node-stage secret", encryptionPassphraseKey)
+	}
+
+	if !isLuks(devPath) {
+		// never encrypt over existing data, e.g. a volume staged without encryption before
+		format, err := ns.Mounter.GetDiskFormat(devPath)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get disk format of %s: %v", devPath, err)
+		}
+		if format != "" {
+			return "", fmt.Errorf("Device %s already has a %s filesystem, refuse to format it with LUKS", devPath, format)
+		}
+
+		log.Infof("Formatting %s with LUKS", devPath)
+		if err := luksFormat(devPath, passphrase); err != nil {
+			return "", err
+		}
+	}
+
+	if err := luksOpen(devPath, name, passphrase, allowDiscards); err != nil {
+		return "", err
+	}
+	log.Infof("Opened LUKS device %s as %s", devPath, luksMapperPath(name))
+
+	return luksMapperPath(name), nil
+}
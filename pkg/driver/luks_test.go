@@ -0,0 +1,39 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_luksMapperName(t *testing.T) {
+	tests := []struct {
+		name     string
+		volumeId string
+		want     string
+	}{
+		{
+			name:     "lun uuid",
+			volumeId: "e3b0c442-98fc-1c14-9afb-f4c8996fb924",
+			want:     "luks-e3b0c442-98fc-1c14-9afb-f4c8996fb924-ad59edfc",
+		},
+		{
+			name:     "invalid chars",
+			volumeId: "k8s-csi-pvc-1/a b",
+			want:     "luks-a-b-dcf754c4",
+		},
+		{
+			name:     "long name",
+			volumeId: strings.Repeat("x", 80),
+			want:     "luks-" + strings.Repeat("x", 64) + "-d929cdee",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := luksMapperName(tt.volumeId); got != tt.want {
+				t.Errorf("luksMapperName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
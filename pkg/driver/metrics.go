@@ -0,0 +1,154 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
+	"github.com/SynologyOpenSource/synology-csi/pkg/metrics"
+)
+
+// the DSM stats are cached between scrapes, so the scrapes of several Prometheus servers don't multiply the requests to DSM
+const dsmStatsTTL = 1 * time.Minute
+
+var (
+	dsmUpDesc = prometheus.NewDesc("synology_csi_dsm_up",
+		"Whether the DSM answered the last ping.", []string{"dsm"}, nil)
+	dsmVolumeSizeDesc = prometheus.NewDesc("synology_csi_dsm_volume_size_bytes",
+		"Total size of the DSM volume.", []string{"dsm", "volume"}, nil)
+	dsmVolumeFreeDesc = prometheus.NewDesc("synology_csi_dsm_volume_free_bytes",
+		"Free size of the DSM volume.", []string{"dsm", "volume"}, nil)
+	dsmObjectsDesc = prometheus.NewDesc("synology_csi_dsm_objects",
+		"Number of LUNs, targets and shares on the DSM.", []string{"dsm", "type"}, nil)
+	dsmObjectLimitDesc = prometheus.NewDesc("synology_csi_dsm_object_limit",
+		"Configured maximum number of LUNs, targets and shares of the DSM.", []string{"dsm", "type"}, nil)
+)
+
+func metricsGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	metrics.GrpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	metrics.GrpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+type dsmCollector struct {
+	dsmService interfaces.IDsmService
+	health     *dsmHealthChecker
+
+	mu          sync.Mutex
+	lastRefresh time.Time
+	cached      []prometheus.Metric
+}
+
+func newDsmCollector(dsmService interfaces.IDsmService, health *dsmHealthChecker) *dsmCollector {
+	return &dsmCollector{
+		dsmService: dsmService,
+		health:     health,
+	}
+}
+
+func (c *dsmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dsmUpDesc
+	ch <- dsmVolumeSizeDesc
+	ch <- dsmVolumeFreeDesc
+	ch <- dsmObjectsDesc
+	ch <- dsmObjectLimitDesc
+}
+
+func (c *dsmCollector) Collect(ch chan<- prometheus.Metric) {
+	for ip, err := range c.health.Results() {
+		up := 0.0
+		if err == nil {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(dsmUpDesc, prometheus.GaugeValue, up, ip)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastRefresh) > dsmStatsTTL {
+		c.cached = c.refresh()
+		c.lastRefresh = time.Now()
+	}
+	for _, m := range c.cached {
+		ch <- m
+	}
+}
+
+func (c *dsmCollector) refresh() []prometheus.Metric {
+	stats := []prometheus.Metric{}
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		stats = append(stats, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...))
+	}
+
+	for _, dsm := range c.dsmService.ListDsms() {
+		if vols, err := dsm.VolumeList(); err != nil {
+			log.Errorf("Failed to list volumes of DSM [%s] for metrics: %v", dsm.Ip, err)
+		} else {
+			for _, vol := range vols {
+				size, _ := strconv.ParseFloat(vol.Size, 64)
+				free, _ := strconv.ParseFloat(vol.Free, 64)
+				gauge(dsmVolumeSizeDesc, size, dsm.Ip, vol.Path)
+				gauge(dsmVolumeFreeDesc, free, dsm.Ip, vol.Path)
+			}
+		}
+
+		if luns, err := dsm.LunList(); err != nil {
+			log.Errorf("Failed to list LUNs of DSM [%s] for metrics: %v", dsm.Ip, err)
+		} else {
+			gauge(dsmObjectsDesc, float64(len(luns)), dsm.Ip, "lun")
+		}
+		if targets, err := dsm.TargetList(); err != nil {
+			log.Errorf("Failed to list targets of DSM [%s] for metrics: %v", dsm.Ip, err)
+		} else {
+			gauge(dsmObjectsDesc, float64(len(targets)), dsm.Ip, "target")
+		}
+		if shares, err := dsm.ShareList(); err != nil {
+			log.Errorf("Failed to list shares of DSM [%s] for metrics: %v", dsm.Ip, err)
+		} else {
+			gauge(dsmObjectsDesc, float64(len(shares)), dsm.Ip, "share")
+		}
+
+		for objectType, limit := range map[string]int{"lun": DsmMaxLuns, "target": DsmMaxTargets, "share": DsmMaxShares} {
+			if limit > 0 {
+				gauge(dsmObjectLimitDesc, float64(limit), dsm.Ip, objectType)
+			}
+		}
+	}
+
+	return stats
+}
+
+// serveMetrics exposes the gRPC, webapi and DSM metrics on MetricsAddress
+func serveMetrics(dsmService interfaces.IDsmService, health *dsmHealthChecker) {
+	if MetricsDsmStats {
+		prometheus.MustRegister(newDsmCollector(dsmService, health))
+	}
+	metrics.Serve(MetricsAddress)
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/metrics"
+)
+
+func Test_metricsGRPC(t *testing.T) {
+	metrics.GrpcRequests.Reset()
+	method := "/csi.v1.Node/NodeStageVolume"
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode string
+	}{
+		{
+			name:     "success",
+			wantCode: "OK",
+		},
+		{
+			name:     "status error",
+			err:      status.Error(codes.NotFound, "Volume[vol-1] is not found"),
+			wantCode: "NotFound",
+		},
+		{
+			name:     "other error",
+			err:      errors.New("Volume[vol-2] failed"),
+			wantCode: "Unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, tt.err
+			}
+			if _, err := metricsGRPC(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler); err != tt.err {
+				t.Errorf("metricsGRPC() error = %v, want %v", err, tt.err)
+			}
+
+			if got := testutil.ToFloat64(metrics.GrpcRequests.WithLabelValues(method, tt.wantCode)); got != 1 {
+				t.Errorf("requests of code %v = %v, want 1", tt.wantCode, got)
+			}
+		})
+	}
+
+	// the code is the label, not the error message with the volume ID
+	if got := testutil.CollectAndCount(metrics.GrpcRequests); got != len(tests) {
+		t.Errorf("request series = %v, want %v", got, len(tests))
+	}
+}
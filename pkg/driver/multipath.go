@@ -72,7 +72,7 @@ func execWithTimeout(command string, args []string, timeout time.Duration) ([]by
 	if err != nil {
 		if ee, ok := err.(utilexec.ExitError); ok {
 			log.Errorf("Non-zero exit code: %s", err)
-			err = fmt.Errorf("%s", ee.ExitStatus())
+			err = fmt.Errorf("exit status %d", ee.ExitStatus())
 		}
 	}
 
@@ -91,6 +91,27 @@ func multipath_resize(devName string) error {
 	return nil
 }
 
+// adds a path device, e.g. sdb, back to its multipath map after the session is re-established
+func multipath_add_path(devName string) error {
+	executor := utilexec.New()
+	cmd := executor.Command("multipathd", "add", "path", devName)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s (%v)", string(out), err)
+	}
+	return nil
+}
+
+// flushes the buffer cache of a block device
+func blockdev_flushbufs(devPath string) error {
+	timeout := 10 * time.Second
+	out, err := execWithTimeout("blockdev", []string{"--flushbufs", devPath}, timeout)
+	if err != nil {
+		return fmt.Errorf("%s (%v)", string(out), err)
+	}
+	return nil
+}
+
 // flushes a multipath device dm-x with command multipath -f /dev/dm-x
 func multipath_flush(devPath string) error {
 	timeout := 5 * time.Second
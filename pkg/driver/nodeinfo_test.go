@@ -0,0 +1,129 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func Test_getInitiatorName(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "debian",
+			content: "## DO NOT EDIT OR REMOVE THIS FILE!\nInitiatorName=iqn.1993-08.org.debian:01:abcdef\n",
+			want:    "iqn.1993-08.org.debian:01:abcdef",
+		},
+		{
+			name:    "commented out",
+			content: "#InitiatorName=iqn.1993-08.org.debian:01:old\n  InitiatorName=iqn.1994-05.com.redhat:1234  \n",
+			want:    "iqn.1994-05.com.redhat:1234",
+		},
+		{
+			name:    "empty name",
+			content: "InitiatorName=\n",
+			wantErr: true,
+		},
+		{
+			name:    "no name",
+			content: "# nothing\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "initiatorname.iscsi")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := getInitiatorName(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getInitiatorName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getInitiatorName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := getInitiatorName(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("getInitiatorName() of a missing file error = nil, want an error")
+	}
+}
+
+func Test_nodeServer_NodeGetInfo(t *testing.T) {
+	defer func(max int64, file string) {
+		MaxVolumesPerNode, InitiatorNameFile = max, file
+	}(MaxVolumesPerNode, InitiatorNameFile)
+	// without an initiator, the node is not annotated and is still reported for the SMB volumes
+	InitiatorNameFile = filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name string
+		max  int64
+	}{
+		{
+			name: "no limit",
+			max:  0,
+		},
+		{
+			name: "limit",
+			max:  64,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxVolumesPerNode = tt.max
+			ns := &nodeServer{Driver: &Driver{nodeID: "node-1"}}
+
+			resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			if err != nil {
+				t.Fatalf("NodeGetInfo() error = %v", err)
+			}
+			if resp.GetNodeId() != "node-1" {
+				t.Errorf("NodeGetInfo() nodeId = %v, want %v", resp.GetNodeId(), "node-1")
+			}
+			if resp.GetMaxVolumesPerNode() != tt.max {
+				t.Errorf("NodeGetInfo() maxVolumesPerNode = %v, want %v", resp.GetMaxVolumesPerNode(), tt.max)
+			}
+		})
+	}
+}
+
+func Test_nodeServer_NodeGetCapabilities(t *testing.T) {
+	d, err := NewControllerAndNodeDriver("node-1", "unix:///csi.sock", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &nodeServer{Driver: d}
+
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetCapabilities() error = %v", err)
+	}
+
+	got := make(map[csi.NodeServiceCapability_RPC_Type]bool)
+	for _, capability := range resp.GetCapabilities() {
+		got[capability.GetRpc().GetType()] = true
+	}
+	for _, want := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	} {
+		if !got[want] {
+			t.Errorf("NodeGetCapabilities() = %v, want %v", resp.GetCapabilities(), want)
+		}
+	}
+}
@@ -19,8 +19,10 @@ package driver
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +32,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/mount-utils"
+	"k8s.io/utils/keymutex"
 
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
@@ -38,10 +41,17 @@ import (
 )
 
 type nodeServer struct {
-	Driver     *Driver
-	Mounter    *mount.SafeFormatAndMount
-	dsmService interfaces.IDsmService
-	Initiator  *initiatorDriver
+	Driver         *Driver
+	Mounter        *mount.SafeFormatAndMount
+	dsmService     interfaces.IDsmService
+	Initiator      *initiatorDriver
+	stagingStore   *stagingStore
+	ephemeralStore *stagingStore
+	volumeLocks    keymutex.KeyMutex
+	targetLocks    keymutex.KeyMutex
+	ephemeralLocks keymutex.KeyMutex
+	supervisor     *sessionSupervisor
+	reclaimer      *reclaimScheduler
 }
 
 func waitForDevicePathToExist(path string) error {
@@ -73,7 +83,7 @@ func getExistedVolumeMountPath(targetIqn string, mappingIndex int) string {
 
 	sessions := listSessionsByIqn(targetIqn)
 	for _, session := range sessions {
-		paths = append(paths, fmt.Sprintf("%sip-%s-iscsi-%s-lun-%d", "/dev/disk/by-path/", session.Portal, targetIqn, mappingIndex))
+		paths = append(paths, getISCSIDevicePath(session.Portal, targetIqn, mappingIndex))
 	}
 
 	return getVolumeMountPath(paths)
@@ -138,56 +148,134 @@ func createTargetMountPath(mounter mount.Interface, mountPath string, isBlock bo
 	return notMount, nil
 }
 
-func (ns *nodeServer) getPortals(dsmIp string) []string {
+func (ns *nodeServer) getPortals(ctx context.Context, dsmIp string, target webapi.TargetInfo, multipathPortals string) []string {
 	portals := []string{}
 
-	dsm, err := ns.dsmService.GetDsm(dsmIp)
+	dsm, err := ns.dsmService.WithContext(ctx).GetDsm(dsmIp)
 	if err != nil {
 		log.Errorf("Failed to get DSM[%s]", dsmIp)
 		return portals
 	}
 
-	ips, err := utils.LookupIPv4(dsmIp)
-	if err != nil {
-		log.Error(err)
-		portals = append(portals, fmt.Sprintf("%s:%d", dsmIp, ISCSIPort))
-	} else {
-		portals = append(portals, fmt.Sprintf("%s:%d", ips[0], ISCSIPort)) //get the first ip
-	}
-
 	if dsm.IsUC() && IsMultipathEnabled() {
+		controllers := []*webapi.DSM{dsm}
 		dsm2, err := dsm.GetAnotherController()
 		if err != nil {
-			log.Errorf("[%s] UC failed to get another controller: %v", err)
+			log.Errorf("[%s] UC failed to get another controller: %v", dsmIp, err)
 		} else {
-			portals = append(portals, fmt.Sprintf("%s:%d", dsm2.Ip, ISCSIPort))
+			controllers = append(controllers, dsm2)
+		}
+
+		for i, controller := range controllers {
+			// a target bound to some interfaces only accepts the logins on their portals of each controller
+			if isTargetBound(target) {
+				candidates, err := getMultipathPortals(controller, target, multipathPortals)
+				if err != nil {
+					log.Errorf("Failed to get portals of target [%s] on controller [%s]: %v", target.Iqn, controller.Ip, err)
+					continue
+				}
+				portals = append(portals, candidates...)
+			} else if i == 0 {
+				portals = append(portals, ns.getDsmPortal(controller))
+			} else {
+				portals = append(portals, getISCSIPortal(controller.Ip))
+			}
 		}
+		return portals
 	}
-	return portals
+
+	dsmPortal := ns.getDsmPortal(dsm)
+
+	// a target bound to some interfaces only accepts the logins on their portals
+	if multipathPortals != "" || isTargetBound(target) {
+		candidates, err := getMultipathPortals(dsm, target, multipathPortals)
+		if err != nil {
+			log.Errorf("Failed to get portals of target [%s], fall back to the portal of DSM[%s]: %v", target.Iqn, dsmIp, err)
+			return append(portals, dsmPortal)
+		}
+
+		if multipathPortals != "" && IsMultipathEnabled() {
+			return candidates
+		}
+		if multipathPortals != "" {
+			log.Warnf("Multipath is disabled, ignore multipath portals %q of target [%s]", multipathPortals, target.Iqn)
+		}
+
+		// single path, prefer the portal of the DSM address if the target listens on it
+		if utils.SliceContains(candidates, dsmPortal) {
+			return append(portals, dsmPortal)
+		}
+		return append(portals, candidates[0])
+	}
+
+	return append(portals, dsmPortal)
 }
 
-func (ns *nodeServer) loginTarget(volumeId string) ([]string, error) {
-	paths := []string{}
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
+func (ns *nodeServer) getDsmPortal(dsm *webapi.DSM) string {
+	ips, err := utils.LookupIP(dsm.Ip, dsm.IpFamily)
+	if err != nil {
+		log.Error(err)
+		return getISCSIPortal(dsm.Ip)
+	}
+	return getISCSIPortal(ips[0]) //get the first ip of the preferred family
+}
+
+// build the staging record of an iSCSI volume by the target info on DSM
+func (ns *nodeServer) getISCSIStagingRecord(ctx context.Context, volumeId string, stagingTargetPath string, multipathPortals string) (*stagingRecord, error) {
+	k8sVolume := ns.dsmService.WithContext(ctx).GetVolume(volumeId)
 
 	if k8sVolume == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume[%s] is not found", volumeId))
 	}
 
-	portals := ns.getPortals(k8sVolume.DsmIp)
+	portals := ns.getPortals(ctx, k8sVolume.DsmIp, k8sVolume.Target, multipathPortals)
 	if len(portals) == 0 {
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get portals"))
 	}
 
-	// Assume target and lun 1-1 mapping
-	mappingIndex := k8sVolume.Target.MappedLuns[0].MappingIndex
-	for _, portal := range portals {
-		if err := ns.Initiator.login(k8sVolume.Target.Iqn, portal); err != nil {
+	mappingIndex, err := k8sVolume.GetMappingIndex()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &stagingRecord{
+		VolumeId:          volumeId,
+		Protocol:          utils.ProtocolIscsi,
+		DsmIp:             k8sVolume.DsmIp,
+		StagingTargetPath: stagingTargetPath,
+		TargetIqn:         k8sVolume.Target.Iqn,
+		Portals:           portals,
+		MappingIndex:      mappingIndex,
+	}, nil
+}
+
+// "10.0.0.1:3260" or "[fd00::1]:3260", the same format as the portals listed by `iscsiadm -m session`
+func getISCSIPortal(ip string) string {
+	return net.JoinHostPort(ip, strconv.Itoa(ISCSIPort))
+}
+
+func getISCSIDevicePath(portal string, targetIqn string, mappingIndex int) string {
+	// udev names the by-path links of IPv6 portals without brackets, e.g. ip-fd00::1:3260-iscsi-...
+	portal = strings.NewReplacer("[", "", "]", "").Replace(portal)
+	return fmt.Sprintf("%sip-%s-iscsi-%s-lun-%d", "/dev/disk/by-path/", portal, targetIqn, mappingIndex)
+}
+
+func (ns *nodeServer) loginTarget(ctx context.Context, record *stagingRecord) ([]string, error) {
+	paths := []string{}
+
+	for _, portal := range record.Portals {
+		if err := ns.Initiator.login(ctx, record.TargetIqn, portal); err != nil {
 			return nil, status.Errorf(codes.Internal,
-				fmt.Sprintf("Failed to login with target iqn [%s], err: %v", k8sVolume.Target.Iqn, err))
+				fmt.Sprintf("Failed to login with target iqn [%s], err: %v", record.TargetIqn, err))
 		}
 
-		path := fmt.Sprintf("%sip-%s-iscsi-%s-lun-%d", "/dev/disk/by-path/", portal, k8sVolume.Target.Iqn, mappingIndex)
+		path := getISCSIDevicePath(portal, record.TargetIqn, record.MappingIndex)
+		if exists, _ := mount.PathExists(path); !exists {
+			// the session may already exist for other LUNs of a shared target, rescan to find the newly mapped LUN
+			if err := ns.Initiator.rescan(ctx, record.TargetIqn); err != nil {
+				log.Errorf("Failed to rescan target [%s]: %v", record.TargetIqn, err)
+			}
+		}
 		if err := waitForDevicePathToExist(path); err != nil {
 			log.Errorf("Can't find device path [%s]: %v", path, err)
 			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Can't find device path [%s]: %v", path, err))
@@ -199,24 +287,235 @@ func (ns *nodeServer) loginTarget(volumeId string) ([]string, error) {
 	return paths, nil
 }
 
-func (ns *nodeServer) logoutTarget(volumeId string) {
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
+// log in to the target portals of the record under the target lock, then save the record, returns the iSCSI device paths
+func (ns *nodeServer) loginAndSaveTarget(ctx context.Context, record *stagingRecord) ([]string, error) {
+	ns.targetLocks.LockKey(record.TargetIqn)
+	defer ns.targetLocks.UnlockKey(record.TargetIqn)
+
+	iscsiDevPaths, err := ns.loginTarget(ctx, record)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// save the record once logged in, so the sessions can be supervised and cleaned up even if the staging fails later
+	if err := ns.stagingStore.Save(record); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to save staging record of volume[%s]: %v", record.VolumeId, err))
+	}
+
+	return iscsiDevPaths, nil
+}
+
+// checks the filesystem of the volume is mounted at the staging path, without DSM access or iSCSI logins, which were
+// done by NodeStageVolume
+func (ns *nodeServer) checkStagedFilesystem(volumeId string, stagingTargetPath string) error {
+	if _, err := ns.stagingStore.Get(volumeId, stagingTargetPath); err != nil {
+		if !os.IsNotExist(err) {
+			return status.Error(codes.Internal, fmt.Sprintf("Failed to get staging record of volume[%s]: %v", volumeId, err))
+		}
+		// staged by an older version, the mount of the staging path is checked below
+		log.Infof("Volume[%s] has no staging record of %s", volumeId, stagingTargetPath)
+	}
 
-	if k8sVolume == nil || k8sVolume.Protocol != utils.ProtocolIscsi {
-		return
+	notMount, err := ns.Mounter.Interface.IsLikelyNotMountPoint(stagingTargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if notMount || os.IsNotExist(err) {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Volume[%s] is not staged at %s", volumeId, stagingTargetPath))
 	}
 
-	// Assume target and lun 1-1 mapping
-	mappingIndex := k8sVolume.Target.MappedLuns[0].MappingIndex
-	volumeMountPath := getExistedVolumeMountPath(k8sVolume.Target.Iqn, mappingIndex)
+	return nil
+}
+
+// returns the device of a staged raw block volume, which is the multipath device if there are several portals
+func (ns *nodeServer) getStagedDevicePath(ctx context.Context, volumeId string, stagingTargetPath string, multipathPortals string) (string, error) {
+	ns.volumeLocks.LockKey(volumeId)
+	defer ns.volumeLocks.UnlockKey(volumeId)
+
+	record, err := ns.stagingStore.Get(volumeId, stagingTargetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", status.Error(codes.Internal, fmt.Sprintf("Failed to get staging record of volume[%s]: %v", volumeId, err))
+		}
 
+		// staged by an older version which logged in at publish, stage it now so it can be unstaged cleanly
+		log.Infof("Volume[%s] has no staging record of %s, login again", volumeId, stagingTargetPath)
+		if record, err = ns.getISCSIStagingRecord(ctx, volumeId, stagingTargetPath, multipathPortals); err != nil {
+			return "", err
+		}
+		if _, err := ns.loginAndSaveTarget(ctx, record); err != nil {
+			return "", err
+		}
+	}
+
+	if record.LuksMapper != "" {
+		if !isLuksOpen(record.LuksMapper) {
+			return "", status.Error(codes.Internal, fmt.Sprintf("Encrypted device of volume[%s] is not opened", volumeId))
+		}
+		return luksMapperPath(record.LuksMapper), nil
+	}
+
+	if record.DevicePath != "" {
+		if exists, _ := mount.PathExists(record.DevicePath); exists {
+			return record.DevicePath, nil
+		}
+		log.Warnf("Device [%s] of volume[%s] is gone, resolve it again", record.DevicePath, volumeId)
+	}
+
+	paths := []string{}
+	for _, portal := range record.Portals {
+		paths = append(paths, getISCSIDevicePath(portal, record.TargetIqn, record.MappingIndex))
+	}
+	devicePath := getVolumeMountPath(paths)
+	if devicePath == "" {
+		return "", status.Error(codes.Internal, "Can't get volume mount path")
+	}
+
+	record.DevicePath = devicePath
+	if err := ns.stagingStore.Save(record); err != nil {
+		log.Errorf("Failed to save staging record of volume[%s]: %v", volumeId, err)
+	}
+	return devicePath, nil
+}
+
+// build the staging record of a volume staged before the records were introduced, which needs DSM access
+func (ns *nodeServer) getLegacyStagingRecord(ctx context.Context, volumeId string, stagingTargetPath string) *stagingRecord {
+	k8sVolume := ns.dsmService.WithContext(ctx).GetVolume(volumeId)
+
+	if k8sVolume == nil {
+		return nil
+	}
+
+	if k8sVolume.Protocol == utils.ProtocolSmb {
+		return &stagingRecord{
+			VolumeId:          volumeId,
+			Protocol:          utils.ProtocolSmb,
+			DsmIp:             k8sVolume.DsmIp,
+			StagingTargetPath: stagingTargetPath,
+			ShareName:         k8sVolume.Share.Name,
+		}
+	}
+
+	mappingIndex, err := k8sVolume.GetMappingIndex()
+	if err != nil {
+		log.Errorf("Failed to get mapping index of volume[%s]: %v", volumeId, err)
+		return nil
+	}
+
+	portals := []string{}
+	for _, session := range listSessionsByIqn(k8sVolume.Target.Iqn) {
+		portals = append(portals, session.Portal)
+	}
+
+	return &stagingRecord{
+		VolumeId:          volumeId,
+		Protocol:          utils.ProtocolIscsi,
+		DsmIp:             k8sVolume.DsmIp,
+		StagingTargetPath: stagingTargetPath,
+		TargetIqn:         k8sVolume.Target.Iqn,
+		Portals:           portals,
+		MappingIndex:      mappingIndex,
+	}
+}
+
+// getStagingRecord looks up the staging journal, and falls back to DSM only for the volumes staged by an older version
+func (ns *nodeServer) getStagingRecord(ctx context.Context, volumeId string, stagingTargetPath string) (*stagingRecord, error) {
+	// an inline volume is staged by its backing volume
+	if ephemeral, err := ns.ephemeralStore.Find(volumeId, ""); err == nil && ephemeral.BackingVolumeId != "" {
+		volumeId, stagingTargetPath = ephemeral.BackingVolumeId, ephemeral.BackingStagingPath
+	}
+
+	record, err := ns.stagingStore.Find(volumeId, stagingTargetPath)
+	if err == nil {
+		return record, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to get staging record of volume[%s]: %v", volumeId, err))
+	}
+
+	if record = ns.getLegacyStagingRecord(ctx, volumeId, stagingTargetPath); record == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume[%s] is not found", volumeId))
+	}
+	return record, nil
+}
+
+// count the other staged volumes sharing the target of the record, a shared target or another staging path of
+// the same volume keeps its LUN or sessions in use
+func (ns *nodeServer) getTargetUsers(record *stagingRecord) (bool, map[string]bool, error) {
+	records, err := ns.stagingStore.List()
+	if err != nil {
+		return false, nil, err
+	}
+
+	lunInUse := false
+	portalInUse := make(map[string]bool)
+	for _, r := range records {
+		if r.TargetIqn != record.TargetIqn ||
+			(r.VolumeId == record.VolumeId && r.StagingTargetPath == record.StagingTargetPath) {
+			continue
+		}
+		if r.MappingIndex == record.MappingIndex {
+			lunInUse = true
+		}
+		for _, portal := range r.Portals {
+			portalInUse[portal] = true
+		}
+	}
+
+	return lunInUse, portalInUse, nil
+}
+
+func (ns *nodeServer) logoutTarget(ctx context.Context, record *stagingRecord) error {
+	// serialize login and logout of the same target, so the users of a shared target are counted correctly
+	ns.targetLocks.LockKey(record.TargetIqn)
+	defer ns.targetLocks.UnlockKey(record.TargetIqn)
+
+	lunInUse, portalInUse, err := ns.getTargetUsers(record)
+	if err != nil {
+		return fmt.Errorf("Failed to list staging records: %v", err)
+	}
+
+	if lunInUse {
+		log.Infof("Volume[%s] LUN %d of target [%s] is still used by other staging paths, skip logout",
+			record.VolumeId, record.MappingIndex, record.TargetIqn)
+		return nil
+	}
+
+	if record.LuksMapper != "" {
+		if err := luksClose(record.LuksMapper); err != nil {
+			return err
+		}
+	}
+
+	volumeMountPath := getExistedVolumeMountPath(record.TargetIqn, record.MappingIndex)
+	if volumeMountPath != "" {
+		// write back the dirty buffers of raw block volumes before the paths are gone
+		if err := blockdev_flushbufs(volumeMountPath); err != nil {
+			log.Errorf("Failed to flush buffers of %s. err: %v", volumeMountPath, err)
+		}
+	}
 	if strings.Contains(volumeMountPath, "/dev/mapper") && IsMultipathEnabled() {
 		if err := multipath_flush(volumeMountPath); err != nil {
 			log.Errorf("Failed to remove multipath device in path %s. err: %v", volumeMountPath, err)
 		}
 	}
 
-	ns.Initiator.logout(k8sVolume.Target.Iqn, k8sVolume.DsmIp)
+	for _, portal := range record.Portals {
+		if !portalInUse[portal] {
+			if err := ns.Initiator.logout(ctx, record.TargetIqn, portal); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// the session is kept for the other LUNs of the target, only remove the device of this LUN
+		log.Infof("Session of target [%s] on portal [%s] is still in use, keep it", record.TargetIqn, portal)
+		if err := removeSCSIDevice(getISCSIDevicePath(portal, record.TargetIqn, record.MappingIndex)); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
 }
 
 func checkGidPresentInMountFlags(volumeMountGroup string, mountFlags []string) (bool, error) {
@@ -233,7 +532,7 @@ func checkGidPresentInMountFlags(volumeMountGroup string, mountFlags []string) (
 	return gidPresentInMountFlags, nil
 }
 
-func (ns *nodeServer) mountSensitiveWithRetry(sourcePath string, targetPath string, fsType string, options []string, sensitiveOptions []string) error {
+func (ns *nodeServer) mountSensitiveWithRetry(ctx context.Context, sourcePath string, targetPath string, fsType string, options []string, sensitiveOptions []string) error {
 	mountBackoff := backoff.NewExponentialBackOff()
 	mountBackoff.InitialInterval = 1 * time.Second
 	mountBackoff.Multiplier = 2
@@ -241,11 +540,9 @@ func (ns *nodeServer) mountSensitiveWithRetry(sourcePath string, targetPath stri
 	mountBackoff.MaxElapsedTime = 5 * time.Second
 
 	checkFinished := func() error {
-		if err := ns.Mounter.MountSensitive(sourcePath, targetPath, fsType, options, sensitiveOptions); err != nil {
-			return err
-		}
-
-		return nil
+		return traceMount(ctx, "mount", targetPath, func() error {
+			return ns.Mounter.MountSensitive(sourcePath, targetPath, fsType, options, sensitiveOptions)
+		})
 	}
 
 	mountNotify := func(err error, duration time.Duration) {
@@ -261,18 +558,234 @@ func (ns *nodeServer) mountSensitiveWithRetry(sourcePath string, targetPath stri
 	return nil
 }
 
-func (ns *nodeServer) setSMBVolumePermission(sourcePath string, userName string, authType utils.AuthType) error {
+func (ns *nodeServer) getSMBSourceShare(ctx context.Context, sourcePath string) (*webapi.DSM, string, error) {
 	s := strings.Split(strings.TrimPrefix(sourcePath, "//"), "/")
 	if len(s) != 2 {
-		return fmt.Errorf("Failed to parse dsmIp and shareName from source path")
+		return nil, "", fmt.Errorf("Failed to parse dsmIp and shareName from source path")
+	}
+	dsmIp, shareName := strings.Trim(s[0], "[]"), s[1] // "//[fd00::1]/share" for IPv6
+
+	dsm, err := ns.dsmService.WithContext(ctx).GetDsm(dsmIp)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to get DSM[%s]", dsmIp)
+	}
+	return dsm, shareName, nil
+}
+
+func (ns *nodeServer) unlockSMBVolume(ctx context.Context, sourcePath string, passphrase string) error {
+	dsm, shareName, err := ns.getSMBSourceShare(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	return dsm.UnlockShare(shareName, passphrase)
+}
+
+func (ns *nodeServer) enableSMBVolumeEncryption(ctx context.Context, sourcePath string) error {
+	dsm, shareName, err := ns.getSMBSourceShare(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	return enableSMBEncryption(dsm, shareName)
+}
+
+// Kerberos requires the service principal name of DSM, so the share is mounted by the server name and connected by the DSM IP
+func (ns *nodeServer) mountSMBVolumeWithKrb5(ctx context.Context, source string, targetPath string, options []string, server string, secrets map[string]string) error {
+	dsm, shareName, err := ns.getSMBSourceShare(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	if server == "" {
+		dsmInfo, err := dsm.DsmInfoGet()
+		if err != nil {
+			return fmt.Errorf("Failed to get DSM[%s] hostname: %v", dsm.Ip, err)
+		}
+		server = dsmInfo.Hostname
+	}
+
+	principal := strings.TrimSpace(secrets[krb5PrincipalKey])
+	// kinit of the same principal shares the keytab and the credential cache
+	ns.targetLocks.LockKey(krb5PrincipalKey + principal)
+	ccache, err := getKrb5Ccache(principal, secrets[krb5KeytabKey])
+	ns.targetLocks.UnlockKey(krb5PrincipalKey + principal)
+	if err != nil {
+		return err
+	}
+
+	options = append(options, "ip="+dsm.Ip)
+	return traceMount(ctx, "mount", targetPath, func() error {
+		return mountCIFSWithCcache(fmt.Sprintf("//%s/%s", server, shareName), targetPath, options, ccache)
+	})
+}
+
+func smbShareLockKey(dsmIp string, shareName string) string {
+	return "//" + dsmIp + "/" + shareName
+}
+
+// grantSMBVolumePermission grants the user read-write permission of the share, and records the grant of this node
+// to be revoked on unstage. The permission given by the admin is never recorded, so it is never revoked.
+func (ns *nodeServer) grantSMBVolumePermission(ctx context.Context, spec *models.NodeStageVolumeSpec, userName string) error {
+	dsm, shareName, err := ns.getSMBSourceShare(ctx, spec.Source)
+	if err != nil {
+		return err
+	}
+
+	client, err := getKubeClient()
+	if err != nil {
+		return fmt.Errorf("Failed to track the grant of user [%s] of share [%s]: %v", userName, shareName, err)
+	}
+
+	// serialize with the revocation on unstage of the same share, the other nodes are serialized by the grants
+	ns.targetLocks.LockKey(smbShareLockKey(dsm.Ip, shareName))
+	defer ns.targetLocks.UnlockKey(smbShareLockKey(dsm.Ip, shareName))
+
+	permission, err := getSMBUserPermission(dsm, shareName, userName)
+	if err != nil {
+		return err
+	}
+
+	// recorded before the permission is set, so a failed stage leaves a grant to be revoked rather than an untracked one
+	adminGranted := false
+	err = updateSmbGrants(ctx, client, dsm.Ip, shareName, func(grants map[string]string) (bool, error) {
+		adminGranted = permission != nil && !isSmbUserGranted(grants, userName)
+		if adminGranted {
+			return false, nil
+		}
+		return addSmbGrant(grants, ns.Driver.nodeID, userName), nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to record the grant of user [%s] of share [%s]: %v", userName, shareName, err)
+	}
+
+	if adminGranted {
+		if !permission.IsWritable {
+			if err := ns.setSMBVolumePermission(dsm, shareName, userName, utils.AuthTypeReadWrite); err != nil {
+				return err
+			}
+		}
+		return ns.saveSMBStagingRecord(ctx, spec, "")
+	}
+
+	// always set, as another node may have revoked the permission after it was listed
+	if err := ns.setSMBVolumePermission(dsm, shareName, userName, utils.AuthTypeReadWrite); err != nil {
+		return err
+	}
+	return ns.saveSMBStagingRecord(ctx, spec, userName)
+}
+
+// getSMBUserPermission returns the permission entry of the local user of the share, nil if it has none
+func getSMBUserPermission(dsm *webapi.DSM, shareName string, userName string) (*webapi.SharePermission, error) {
+	permissions, err := dsm.SharePermissionList(shareName, models.UserGroupTypeLocalUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list permissions of share [%s]: %v", shareName, err)
+	}
+
+	for i, permission := range permissions {
+		if strings.EqualFold(permission.Name, userName) && (permission.IsWritable || permission.IsReadonly || permission.IsDeny) {
+			return &permissions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// saveSMBStagingRecord journals the staged share, with the user granted by this stage if any
+func (ns *nodeServer) saveSMBStagingRecord(ctx context.Context, spec *models.NodeStageVolumeSpec, userName string) error {
+	dsm, shareName, err := ns.getSMBSourceShare(ctx, spec.Source)
+	if err != nil {
+		return err
+	}
+
+	record := &stagingRecord{
+		VolumeId:          spec.VolumeId,
+		Protocol:          utils.ProtocolSmb,
+		DsmIp:             dsm.Ip,
+		StagingTargetPath: spec.StagingTargetPath,
+		ShareName:         shareName,
+		SmbUser:           userName,
+	}
+	if err := ns.stagingStore.Save(record); err != nil {
+		return fmt.Errorf("Failed to save staging record: %v", err)
+	}
+	return nil
+}
+
+// the user is still in use by another staging path of the share on this node
+func (ns *nodeServer) isSMBUserInUse(record *stagingRecord) (bool, error) {
+	records, err := ns.stagingStore.List()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		if r.Protocol != utils.ProtocolSmb || r.DsmIp != record.DsmIp || r.ShareName != record.ShareName ||
+			r.SmbUser != record.SmbUser || (r.VolumeId == record.VolumeId && r.StagingTargetPath == record.StagingTargetPath) {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// revokeSMBVolumePermission removes the grant of this node from the share, and the permission of the user when
+// no other node has granted it
+func (ns *nodeServer) revokeSMBVolumePermission(ctx context.Context, record *stagingRecord) error {
+	dsm, err := ns.dsmService.WithContext(ctx).GetDsm(record.DsmIp)
+	if err != nil {
+		return fmt.Errorf("Failed to get DSM[%s]", record.DsmIp)
+	}
+
+	client, err := getKubeClient()
+	if err != nil {
+		return fmt.Errorf("Failed to remove the grant of user [%s] of share [%s]: %v", record.SmbUser, record.ShareName, err)
 	}
-	dsmIp, shareName := s[0], s[1]
 
-	dsm, err := ns.dsmService.GetDsm(dsmIp)
+	ns.targetLocks.LockKey(smbShareLockKey(dsm.Ip, record.ShareName))
+	defer ns.targetLocks.UnlockKey(smbShareLockKey(dsm.Ip, record.ShareName))
+
+	inUse, err := ns.isSMBUserInUse(record)
 	if err != nil {
-		return fmt.Errorf("Failed to get DSM[%s]", dsmIp)
+		return err
+	}
+	if inUse {
+		log.Debugf("User [%s] is still in use, keep its permission of share [%s]", record.SmbUser, record.ShareName)
+		return nil
 	}
 
+	// the permission is revoked before the grants are saved, if another node has granted the user meanwhile,
+	// saving fails on the conflict and the permission is restored with the new grants
+	revoked := false
+	return updateSmbGrants(ctx, client, dsm.Ip, record.ShareName, func(grants map[string]string) (bool, error) {
+		changed := removeSmbGrant(grants, ns.Driver.nodeID, record.SmbUser)
+
+		if isSmbUserGranted(grants, record.SmbUser) {
+			if revoked {
+				log.Infof("[%s] Restore permission of share [%s] of user [%s] granted by another node", dsm.Ip, record.ShareName, record.SmbUser)
+				if err := ns.setSMBVolumePermission(dsm, record.ShareName, record.SmbUser, utils.AuthTypeReadWrite); err != nil {
+					return false, err
+				}
+				revoked = false
+			} else {
+				log.Debugf("User [%s] is still granted by other nodes, keep its permission of share [%s]", record.SmbUser, record.ShareName)
+			}
+			return changed, nil
+		}
+
+		if !revoked {
+			log.Infof("[%s] Revoke permission of share [%s] from user [%s]", dsm.Ip, record.ShareName, record.SmbUser)
+			if err := dsm.SharePermissionSet(webapi.SharePermissionSetSpec{
+				Name:          record.ShareName,
+				UserGroupType: models.UserGroupTypeLocalUser,
+				Permissions:   []*webapi.SharePermission{{Name: record.SmbUser}}, // no permission flag removes the entry
+			}); err != nil {
+				return false, err
+			}
+			revoked = true
+		}
+		// saved even if unchanged, so a grant of another node made meanwhile conflicts
+		return true, nil
+	})
+}
+
+func (ns *nodeServer) setSMBVolumePermission(dsm *webapi.DSM, shareName string, userName string, authType utils.AuthType) error {
 	permission := webapi.SharePermission{
 		Name: userName,
 	}
@@ -297,15 +810,16 @@ func (ns *nodeServer) setSMBVolumePermission(sourcePath string, userName string,
 	return dsm.SharePermissionSet(spec)
 }
 
-func (ns *nodeServer) nodeStageISCSIVolume(ctx context.Context, spec *models.NodeStageVolumeSpec) (*csi.NodeStageVolumeResponse, error) {
-	// if block mode, skip mount
-	if spec.VolumeCapability.GetBlock() != nil {
-		return &csi.NodeStageVolumeResponse{}, nil
+func (ns *nodeServer) nodeStageISCSIVolume(ctx context.Context, spec *models.NodeStageVolumeSpec, secrets map[string]string) (*csi.NodeStageVolumeResponse, error) {
+	record, err := ns.getISCSIStagingRecord(ctx, spec.VolumeId, spec.StagingTargetPath, spec.MultipathPortals)
+	if err != nil {
+		return nil, err
 	}
+	record.Reclaim = spec.IsThinProvisioning && spec.ReclaimSpace && spec.VolumeCapability.GetBlock() == nil
 
-	iscsiDevPaths, err := ns.loginTarget(spec.VolumeId)
+	iscsiDevPaths, err := ns.loginAndSaveTarget(ctx, record)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
 	volumeMountPath := getVolumeMountPath(iscsiDevPaths)
@@ -313,6 +827,26 @@ func (ns *nodeServer) nodeStageISCSIVolume(ctx context.Context, spec *models.Nod
 		return nil, status.Error(codes.Internal, "Can't get volume mount path")
 	}
 
+	record.DevicePath = volumeMountPath
+	if spec.Encrypted {
+		record.LuksMapper = luksMapperName(spec.VolumeId)
+	}
+	if err := ns.stagingStore.Save(record); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to save staging record of volume[%s]: %v", spec.VolumeId, err))
+	}
+
+	if spec.Encrypted {
+		volumeMountPath, err = ns.openEncryptedDevice(record.DevicePath, record.LuksMapper, secrets[encryptionPassphraseKey], record.Reclaim)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Volume[%s] failed to open encrypted device: %v", spec.VolumeId, err))
+		}
+	}
+
+	// if block mode, skip mount, the device is bind-mounted to each target path by NodePublishVolume
+	if spec.VolumeCapability.GetBlock() != nil {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	notMount, err := ns.Mounter.Interface.IsLikelyNotMountPoint(spec.StagingTargetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -323,21 +857,20 @@ func (ns *nodeServer) nodeStageISCSIVolume(ctx context.Context, spec *models.Nod
 	}
 
 	fsType := spec.VolumeCapability.GetMount().GetFsType()
+	fsOpts, err := parseFsOptions(fsType, spec.FsOptions)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	options := append([]string{"rw"}, spec.VolumeCapability.GetMount().GetMountFlags()...)
+	options = append(options, fsOpts.MountOptions...)
 	volumeMountGroup := spec.VolumeCapability.GetMount().GetVolumeMountGroup()
 
-	formatOptions := []string{}
-
-	if spec.IsThinProvisioning {
-		switch fsType {
-		case "ext4":
-			formatOptions = append(formatOptions, "-E", "nodiscard")
-		case "btrfs":
-			formatOptions = append(formatOptions, "--nodiscard")
-		}
-	}
+	formatOptions := fsOpts.FormatOptions(spec.IsThinProvisioning)
 
-	if err = ns.Mounter.FormatAndMountSensitiveWithFormatOptions(volumeMountPath, spec.StagingTargetPath, fsType, options, nil, formatOptions); err != nil {
+	if err = traceMount(ctx, "format and mount", spec.StagingTargetPath, func() error {
+		return ns.Mounter.FormatAndMountSensitiveWithFormatOptions(volumeMountPath, spec.StagingTargetPath, fsType, options, nil, formatOptions)
+	}); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -374,13 +907,41 @@ func (ns *nodeServer) nodeStageSMBVolume(ctx context.Context, spec *models.NodeS
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Missing secrets for node staging volume"))
 	}
 
+	// validated again for the static PVs and the PVs created before the SMB options
+	smbOpts, err := parseSmbOptions(spec.SmbOptions)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountFlags := spec.VolumeCapability.GetMount().GetMountFlags()
+	if err := validateSmbMountFlags(mountFlags, smbOpts.Seal); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid mount options: %v", err))
+	}
+
 	username := strings.TrimSpace(secrets["username"])
 	password := strings.TrimSpace(secrets["password"])
 	domain := strings.TrimSpace(secrets["domain"])
 
-	// set permission to access the share
-	if err := ns.setSMBVolumePermission(spec.Source, username, utils.AuthTypeReadWrite); err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to set permission, source: %s, err: %v", spec.Source, err))
+	// the encrypted share is locked after DSM reboots
+	if spec.Encrypted {
+		if err := ns.unlockSMBVolume(ctx, spec.Source, secrets[encryptionPassphraseKey]); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to unlock share, source: %s, err: %v", spec.Source, err))
+		}
+	}
+
+	// the shares of the static PVs and of the PVs created before the SMB options don't require the encryption yet
+	if smbOpts.Seal {
+		if err := ns.enableSMBVolumeEncryption(ctx, spec.Source); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to enable SMB encryption, source: %s, err: %v", spec.Source, err))
+		}
+	}
+
+	// set permission to access the share, the AD principals of krb5 mounts are granted by the controller
+	if smbOpts.Security != smbSecurityKrb5 {
+		if err := ns.grantSMBVolumePermission(ctx, spec, username); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to set permission, source: %s, err: %v", spec.Source, err))
+		}
+	} else if err := ns.saveSMBStagingRecord(ctx, spec, ""); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	// create mount point if not exists
@@ -395,7 +956,7 @@ func (ns *nodeServer) nodeStageSMBVolume(ctx context.Context, spec *models.NodeS
 	}
 
 	fsType := "cifs"
-	options := spec.VolumeCapability.GetMount().GetMountFlags()
+	options := append(append([]string{}, mountFlags...), smbOpts.MountOptions(mountFlags)...)
 
 	volumeMountGroup := spec.VolumeCapability.GetMount().GetVolumeMountGroup()
 	gidPresent, err := checkGidPresentInMountFlags(volumeMountGroup, options)
@@ -406,11 +967,19 @@ func (ns *nodeServer) nodeStageSMBVolume(ctx context.Context, spec *models.NodeS
 		options = append(options, fmt.Sprintf("gid=%s", volumeMountGroup))
 	}
 
+	if smbOpts.Security == smbSecurityKrb5 {
+		if err := ns.mountSMBVolumeWithKrb5(ctx, spec.Source, targetPath, options, smbOpts.Krb5Server, secrets); err != nil {
+			return nil, status.Error(codes.Internal,
+				fmt.Sprintf("Volume[%s] failed to mount %q on %q with Kerberos. err: %v", spec.VolumeId, spec.Source, targetPath, err))
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	if domain != "" {
 		options = append(options, fmt.Sprintf("%s=%s", "domain", domain))
 	}
 	var sensitiveOptions = []string{fmt.Sprintf("%s=%s,%s=%s", "username", username, "password", password)}
-	if err := ns.mountSensitiveWithRetry(spec.Source, targetPath, fsType, options, sensitiveOptions); err != nil {
+	if err := ns.mountSensitiveWithRetry(ctx, spec.Source, targetPath, fsType, options, sensitiveOptions); err != nil {
 		return nil, status.Error(codes.Internal,
 			fmt.Sprintf("Volume[%s] failed to mount %q on %q. err: %v", spec.VolumeId, spec.Source, targetPath, err))
 	}
@@ -430,6 +999,9 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.InvalidArgument, "Cannot mix block and mount capabilities")
 	}
 
+	ns.volumeLocks.LockKey(volumeId)
+	defer ns.volumeLocks.UnlockKey(volumeId)
+
 	spec := &models.NodeStageVolumeSpec{
 		VolumeId:           volumeId,
 		StagingTargetPath:  stagingTargetPath,
@@ -437,13 +1009,28 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		Dsm:                req.VolumeContext["dsm"],
 		Source:             req.VolumeContext["source"], // filled by CreateVolume response
 		IsThinProvisioning: utils.StringToBoolean(req.VolumeContext["is_thin_provisioning"]),
+		MultipathPortals:   req.VolumeContext["multipath_portals"],
+		FsOptions:          make(map[string]string),
+		SmbOptions:         make(map[string]string),
+		ReclaimSpace:       req.VolumeContext["reclaim_space"] == "" || utils.StringToBoolean(req.VolumeContext["reclaim_space"]),
+		Encrypted:          utils.StringToBoolean(req.VolumeContext[encryptedKey]),
+	}
+	for _, key := range fsOptionKeys {
+		if value, ok := req.VolumeContext[key]; ok {
+			spec.FsOptions[key] = value
+		}
+	}
+	for _, key := range smbOptionKeys {
+		if value, ok := req.VolumeContext[key]; ok {
+			spec.SmbOptions[key] = value
+		}
 	}
 
 	switch req.VolumeContext["protocol"] {
 	case utils.ProtocolSmb:
 		return ns.nodeStageSMBVolume(ctx, spec, req.GetSecrets())
 	default:
-		return ns.nodeStageISCSIVolume(ctx, spec)
+		return ns.nodeStageISCSIVolume(ctx, spec, req.GetSecrets())
 	}
 }
 
@@ -457,23 +1044,68 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	ns.volumeLocks.LockKey(volumeID)
+	defer ns.volumeLocks.UnlockKey(volumeID)
+
+	// nothing is mounted on the staging path of a raw block volume, which may not exist at all
 	notMount, err := mount.IsNotMountPoint(ns.Mounter.Interface, stagingTargetPath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	if !notMount {
-		err = ns.Mounter.Interface.Unmount(stagingTargetPath)
+	if err == nil && !notMount {
+		err = traceMount(ctx, "unmount", stagingTargetPath, func() error {
+			return ns.Mounter.Interface.Unmount(stagingTargetPath)
+		})
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
-	ns.logoutTarget(volumeID)
+	record, err := ns.stagingStore.Get(volumeID, stagingTargetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to get staging record of volume[%s]: %v", volumeID, err)
+		}
+		record = ns.getLegacyStagingRecord(ctx, volumeID, stagingTargetPath)
+	}
+
+	if record == nil {
+		record = &stagingRecord{VolumeId: volumeID, StagingTargetPath: stagingTargetPath}
+	}
+	if err := ns.releaseStagedVolume(ctx, record); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// releaseStagedVolume logs out the iSCSI sessions or revokes the SMB permission of an unmounted volume, then
+// deletes its staging record. It only needs the record, so it works while DSM is unreachable.
+func (ns *nodeServer) releaseStagedVolume(ctx context.Context, record *stagingRecord) error {
+	if record.Protocol == utils.ProtocolIscsi {
+		if err := ns.logoutTarget(ctx, record); err != nil {
+			return fmt.Errorf("Failed to logout volume[%s]: %v", record.VolumeId, err)
+		}
+	}
+
+	// a stale grant is left on failure, which is removed with the share in DeleteVolume
+	if record.Protocol == utils.ProtocolSmb && record.SmbUser != "" {
+		if err := ns.revokeSMBVolumePermission(ctx, record); err != nil {
+			log.Errorf("Failed to revoke SMB permission of volume[%s]: %v", record.VolumeId, err)
+		}
+	}
+
+	if err := ns.stagingStore.Delete(record.VolumeId, record.StagingTargetPath); err != nil {
+		log.Errorf("Failed to delete staging record of volume[%s]: %v", record.VolumeId, err)
+	}
+	return nil
+}
+
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if isEphemeralVolume(req.GetVolumeContext()) {
+		return ns.nodePublishEphemeralVolume(ctx, req)
+	}
+
 	volumeId, targetPath, stagingTargetPath := req.GetVolumeId(), req.GetTargetPath(), req.GetStagingTargetPath()
 
 	if volumeId == "" || targetPath == "" || stagingTargetPath == "" {
@@ -503,26 +1135,33 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	switch req.VolumeContext["protocol"] {
 	case utils.ProtocolSmb:
-		if err := ns.Mounter.Interface.Mount(stagingTargetPath, targetPath, "", options); err != nil {
+		if err := traceMount(ctx, "mount", targetPath, func() error {
+			return ns.Mounter.Interface.Mount(stagingTargetPath, targetPath, "", options)
+		}); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	default:
-		iscsiDevPaths, err := ns.loginTarget(volumeId)
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+		if isBlock {
+			devicePath, err := ns.getStagedDevicePath(ctx, volumeId, stagingTargetPath, req.VolumeContext["multipath_portals"])
+			if err != nil {
+				return nil, err
+			}
 
-		volumeMountPath := getVolumeMountPath(iscsiDevPaths)
-		if volumeMountPath == "" {
-			return nil, status.Error(codes.Internal, "Can't get volume mount path")
+			if err := traceMount(ctx, "mount", targetPath, func() error {
+				return ns.Mounter.Interface.Mount(devicePath, targetPath, "", options)
+			}); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			break
 		}
 
-		if isBlock {
-			err = ns.Mounter.Interface.Mount(volumeMountPath, targetPath, "", options)
-		} else {
-			err = ns.Mounter.Interface.Mount(stagingTargetPath, targetPath, fsType, options)
+		if err := ns.checkStagedFilesystem(volumeId, stagingTargetPath); err != nil {
+			return nil, err
 		}
-		if err != nil {
+
+		if err := traceMount(ctx, "mount", targetPath, func() error {
+			return ns.Mounter.Interface.Mount(stagingTargetPath, targetPath, fsType, options)
+		}); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
@@ -540,40 +1179,65 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if record, err := ns.ephemeralStore.Get(req.GetVolumeId(), targetPath); err == nil {
+		return ns.nodeUnpublishEphemeralVolume(ctx, record)
+	} else if !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := ns.unmountTargetPath(ctx, targetPath); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) unmountTargetPath(ctx context.Context, targetPath string) error {
 	if _, err := os.Stat(targetPath); err != nil {
 		if os.IsNotExist(err) {
-			return &csi.NodeUnpublishVolumeResponse{}, nil
+			return nil
 		}
-		return nil, status.Errorf(codes.Internal, err.Error())
+		return status.Errorf(codes.Internal, err.Error())
 	}
 
 	notMount, err := mount.IsNotMountPoint(ns.Mounter.Interface, targetPath)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return status.Error(codes.Internal, err.Error())
 	}
 
 	if notMount {
-		return &csi.NodeUnpublishVolumeResponse{}, nil
+		return nil
 	}
 
-	if err := ns.Mounter.Interface.Unmount(targetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := traceMount(ctx, "unmount", targetPath, func() error {
+		return ns.Mounter.Interface.Unmount(targetPath)
+	}); err != nil {
+		return status.Error(codes.Internal, err.Error())
 	}
 
 	if err := os.Remove(targetPath); err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to remove target path.")
+		return status.Errorf(codes.Internal, "Failed to remove target path.")
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return nil
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	log.Debugf("Using default NodeGetInfo, ns.Driver.nodeID = [%s]", ns.Driver.nodeID)
+	resp := &csi.NodeGetInfoResponse{
+		NodeId:            ns.Driver.nodeID,
+		MaxVolumesPerNode: MaxVolumesPerNode,
+	}
 
-	return &csi.NodeGetInfoResponse{
-		NodeId: ns.Driver.nodeID,
-	}, nil
+	// the node is still usable for SMB volumes without an initiator
+	if iqn, err := getInitiatorName(InitiatorNameFile); err != nil {
+		log.Warnf("Failed to get initiator name of node [%s]: %v", ns.Driver.nodeID, err)
+	} else if err := annotateNodeInitiator(ctx, ns.Driver.nodeID, iqn); err != nil {
+		log.Errorf("Failed to annotate node [%s] with initiator [%s]: %v", ns.Driver.nodeID, iqn, err)
+	}
+
+	log.Infof("NodeGetInfo: nodeId = [%s], maxVolumesPerNode = %d", resp.NodeId, resp.MaxVolumesPerNode)
+	return resp, nil
 }
 
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -588,39 +1252,52 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "Invalid Argument")
 	}
 
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
-	if k8sVolume == nil {
-		return nil, status.Error(codes.NotFound,
-			fmt.Sprintf("Volume[%s] is not found", volumeId))
+	record, err := ns.getStagingRecord(ctx, volumeId, req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
 	}
 
 	notMount, err := mount.IsNotMountPoint(ns.Mounter.Interface, volumePath)
+	if err != nil && mount.IsCorruptedMnt(err) {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: abnormalVolumeCondition(fmt.Sprintf("Volume[%s] mount on %s is stale: %v", volumeId, volumePath, err)),
+		}, nil
+	}
 	if err != nil || notMount {
 		return nil, status.Error(codes.NotFound,
 			fmt.Sprintf("Volume[%s] does not exist on the %s", volumeId, volumePath))
 	}
 
-	if k8sVolume.Protocol == utils.ProtocolSmb {
+	// raw block volumes have no filesystem to statfs, report the device size instead
+	if isBlockDevice(volumePath) {
+		size, err := getBlockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to get size of %s: %v", volumePath, err))
+		}
 		return &csi.NodeGetVolumeStatsResponse{
 			Usage: []*csi.VolumeUsage{
 				&csi.VolumeUsage{
-					Total: k8sVolume.SizeInBytes,
+					Total: size,
 					Unit:  csi.VolumeUsage_BYTES,
 				},
 			},
+			VolumeCondition: ns.getVolumeCondition(volumeId, volumePath, record),
 		}, nil
 	}
 
-	lun := k8sVolume.Lun
+	usage, err := getVolumeUsage(volumePath)
+	if err != nil {
+		if mount.IsCorruptedMnt(err) {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: abnormalVolumeCondition(fmt.Sprintf("Volume[%s] mount on %s is stale: %v", volumeId, volumePath, err)),
+			}, nil
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to get fs stats of %s: %v", volumePath, err))
+	}
+
 	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			&csi.VolumeUsage{
-				Available: int64(lun.Size - lun.Used),
-				Total:     int64(lun.Size),
-				Used:      int64(lun.Used),
-				Unit:      csi.VolumeUsage_BYTES,
-			},
-		},
+		Usage:           usage,
+		VolumeCondition: ns.getVolumeCondition(volumeId, volumePath, record),
 	}, nil
 }
 
@@ -631,23 +1308,24 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		return nil, status.Error(codes.InvalidArgument, "InvalidArgument: Please check volume ID and volume path.")
 	}
 
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
-	if k8sVolume == nil {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume[%s] is not found", volumeId))
+	record, err := ns.getStagingRecord(ctx, volumeId, req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
 	}
 
-	if k8sVolume.Protocol == utils.ProtocolSmb {
+	if record.Protocol == utils.ProtocolSmb {
 		return &csi.NodeExpandVolumeResponse{
 			CapacityBytes: sizeInByte}, nil
 	}
 
-	if err := ns.Initiator.rescan(k8sVolume.Target.Iqn); err != nil {
+	if err := ns.Initiator.rescan(ctx, record.TargetIqn); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to rescan. err: %v", err))
 	}
 
-	// Assume target and lun 1-1 mapping
-	mappingIndex := k8sVolume.Target.MappedLuns[0].MappingIndex
-	volumeMountPath := getExistedVolumeMountPath(k8sVolume.Target.Iqn, mappingIndex)
+	volumeMountPath := record.DevicePath
+	if exists, _ := mount.PathExists(volumeMountPath); !exists {
+		volumeMountPath = getExistedVolumeMountPath(record.TargetIqn, record.MappingIndex)
+	}
 	if volumeMountPath == "" {
 		return nil, status.Error(codes.Internal, "Can't get volume mount path")
 	}
@@ -658,6 +1336,13 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		}
 	}
 
+	if record.LuksMapper != "" {
+		if err := luksResize(record.LuksMapper); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to resize encrypted device %s. err: %v", record.LuksMapper, err))
+		}
+		volumeMountPath = luksMapperPath(record.LuksMapper)
+	}
+
 	isBlock := req.GetVolumeCapability() != nil && req.GetVolumeCapability().GetBlock() != nil
 	if isBlock {
 		return &csi.NodeExpandVolumeResponse{
@@ -0,0 +1,221 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/keymutex"
+)
+
+func Test_nodeServer_checkStagedFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	stagedPath := filepath.Join(dir, "staged")
+	notMountedPath := filepath.Join(dir, "not-mounted")
+	for _, path := range []string{stagedPath, notMountedPath} {
+		if err := os.Mkdir(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ns := &nodeServer{
+		Mounter: &mount.SafeFormatAndMount{
+			Interface: mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/sda", Path: stagedPath}}),
+		},
+		stagingStore: newStagingStore(filepath.Join(dir, "records")),
+	}
+	if err := ns.stagingStore.Save(&stagingRecord{VolumeId: "vol-1", StagingTargetPath: stagedPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		volumeId          string
+		stagingTargetPath string
+		wantCode          codes.Code
+	}{
+		{
+			name:              "staged",
+			volumeId:          "vol-1",
+			stagingTargetPath: stagedPath,
+			wantCode:          codes.OK,
+		},
+		{
+			name:              "staged by an older version without a record",
+			volumeId:          "vol-2",
+			stagingTargetPath: stagedPath,
+			wantCode:          codes.OK,
+		},
+		{
+			name:              "staging path not mounted",
+			volumeId:          "vol-3",
+			stagingTargetPath: notMountedPath,
+			wantCode:          codes.FailedPrecondition,
+		},
+		{
+			name:              "staging path missing",
+			volumeId:          "vol-4",
+			stagingTargetPath: filepath.Join(dir, "missing"),
+			wantCode:          codes.FailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ns.checkStagedFilesystem(tt.volumeId, tt.stagingTargetPath)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("checkStagedFilesystem() error = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_nodeServer_getTargetUsers(t *testing.T) {
+	ns := &nodeServer{stagingStore: newStagingStore(filepath.Join(t.TempDir(), "records"))}
+
+	shared := "iqn.2000-01.com.synology:dsm.csi-shared-single-0"
+	records := []*stagingRecord{
+		{VolumeId: "vol-1", StagingTargetPath: "/staging/1", TargetIqn: shared, MappingIndex: 0, Portals: []string{"10.0.0.1:3260"}},
+		{VolumeId: "vol-2", StagingTargetPath: "/staging/2", TargetIqn: shared, MappingIndex: 1, Portals: []string{"10.0.0.1:3260", "10.0.1.1:3260"}},
+		{VolumeId: "vol-3", StagingTargetPath: "/staging/3a", TargetIqn: "iqn.2000-01.com.synology:dsm.csi-vol-3", Portals: []string{"10.0.0.1:3260"}},
+		{VolumeId: "vol-3", StagingTargetPath: "/staging/3b", TargetIqn: "iqn.2000-01.com.synology:dsm.csi-vol-3", Portals: []string{"10.0.0.1:3260"}},
+		{VolumeId: "vol-4", StagingTargetPath: "/staging/4", TargetIqn: "iqn.2000-01.com.synology:dsm.csi-vol-4", Portals: []string{"10.0.0.1:3260"}},
+	}
+	for _, record := range records {
+		if err := ns.stagingStore.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		record          *stagingRecord
+		wantLunInUse    bool
+		wantPortalInUse map[string]bool
+	}{
+		{
+			name:            "other LUN of a shared target",
+			record:          records[0],
+			wantLunInUse:    false,
+			wantPortalInUse: map[string]bool{"10.0.0.1:3260": true, "10.0.1.1:3260": true},
+		},
+		{
+			name:            "last LUN of a shared target",
+			record:          &stagingRecord{VolumeId: "vol-5", StagingTargetPath: "/staging/5", TargetIqn: shared, MappingIndex: 2},
+			wantLunInUse:    false,
+			wantPortalInUse: map[string]bool{"10.0.0.1:3260": true, "10.0.1.1:3260": true},
+		},
+		{
+			name:            "same volume at another staging path",
+			record:          records[2],
+			wantLunInUse:    true,
+			wantPortalInUse: map[string]bool{"10.0.0.1:3260": true},
+		},
+		{
+			name:            "dedicated target",
+			record:          records[4],
+			wantLunInUse:    false,
+			wantPortalInUse: map[string]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lunInUse, portalInUse, err := ns.getTargetUsers(tt.record)
+			if err != nil {
+				t.Fatalf("getTargetUsers() error = %v", err)
+			}
+			if lunInUse != tt.wantLunInUse {
+				t.Errorf("getTargetUsers() lunInUse = %v, want %v", lunInUse, tt.wantLunInUse)
+			}
+			if !reflect.DeepEqual(portalInUse, tt.wantPortalInUse) {
+				t.Errorf("getTargetUsers() portalInUse = %v, want %v", portalInUse, tt.wantPortalInUse)
+			}
+		})
+	}
+}
+
+func Test_nodeServer_logoutTarget_lunInUse(t *testing.T) {
+	ns := &nodeServer{
+		stagingStore: newStagingStore(filepath.Join(t.TempDir(), "records")),
+		targetLocks:  keymutex.NewHashed(0),
+	}
+
+	iqn := "iqn.2000-01.com.synology:dsm.csi-vol-1"
+	record := &stagingRecord{VolumeId: "vol-1", StagingTargetPath: "/staging/a", TargetIqn: iqn, Portals: []string{"10.0.0.1:3260"}}
+	other := &stagingRecord{VolumeId: "vol-1", StagingTargetPath: "/staging/b", TargetIqn: iqn, Portals: []string{"10.0.0.1:3260"}}
+	for _, r := range []*stagingRecord{record, other} {
+		if err := ns.stagingStore.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the LUN is still staged at the other path, so neither the sessions nor the device are touched
+	if err := ns.logoutTarget(context.Background(), record); err != nil {
+		t.Errorf("logoutTarget() error = %v, want nil", err)
+	}
+}
+
+func Test_nodeServer_getStagedDevicePath(t *testing.T) {
+	dir := t.TempDir()
+	devicePath := filepath.Join(dir, "dm-0")
+	if err := ioutil.WriteFile(devicePath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &nodeServer{
+		stagingStore: newStagingStore(filepath.Join(dir, "records")),
+		volumeLocks:  keymutex.NewHashed(0),
+	}
+	records := []*stagingRecord{
+		{VolumeId: "vol-1", StagingTargetPath: "/staging/1", DevicePath: devicePath, Portals: []string{"10.0.0.1:3260", "10.0.1.1:3260"}},
+		{VolumeId: "vol-2", StagingTargetPath: "/staging/2", DevicePath: devicePath, LuksMapper: "synology-csi-test-not-opened"},
+		{VolumeId: "vol-3", StagingTargetPath: "/staging/3", DevicePath: filepath.Join(dir, "dm-gone")},
+	}
+	for _, record := range records {
+		if err := ns.stagingStore.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		record   *stagingRecord
+		want     string
+		wantCode codes.Code
+	}{
+		{
+			name:     "multipath device of the record",
+			record:   records[0],
+			want:     devicePath,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "encrypted device not opened",
+			record:   records[1],
+			wantCode: codes.Internal,
+		},
+		{
+			name:     "device gone without portals",
+			record:   records[2],
+			wantCode: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ns.getStagedDevicePath(context.Background(), tt.record.VolumeId, tt.record.StagingTargetPath, "")
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("getStagedDevicePath() error = %v, want code %v", err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Errorf("getStagedDevicePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
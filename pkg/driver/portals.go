@@ -0,0 +1,132 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// MultipathPortalsAll logs in to every reachable portal of the target
+const MultipathPortalsAll = "all"
+
+// parseMultipathPortals parses the multipath_portals option, which is either "all"
+// or a comma-separated list of DSM interface names or IPs, e.g. "eth0,eth1" or "10.0.0.1,10.0.1.1"
+func parseMultipathPortals(option string) ([]string, error) {
+	option = strings.TrimSpace(option)
+	if option == "" || strings.EqualFold(option, MultipathPortalsAll) {
+		return nil, nil
+	}
+
+	selected := []string{}
+	for _, item := range strings.Split(option, ",") {
+		item = strings.Trim(strings.TrimSpace(item), "[]")
+		if item == "" {
+			return nil, fmt.Errorf("Invalid multipath portals: %q", option)
+		}
+		selected = append(selected, item)
+	}
+	return selected, nil
+}
+
+func isTargetBound(target webapi.TargetInfo) bool {
+	for _, portal := range target.NetworkPortals {
+		if portal.InterfaceName == webapi.NetworkPortalAllInterfaces {
+			return false
+		}
+	}
+	return len(target.NetworkPortals) > 0
+}
+
+// the target listens on all interfaces unless it is bound to some of them
+func isTargetListeningOn(target webapi.TargetInfo, ifname string) bool {
+	if !isTargetBound(target) {
+		return true
+	}
+
+	for _, portal := range target.NetworkPortals {
+		if portal.InterfaceName == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+func getPreferredIp(ips []string, ipFamily string) string {
+	for _, ip := range ips {
+		if utils.IsIPv6(ip) == (ipFamily == utils.IpFamilyIPv6) {
+			return ip
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0]
+	}
+	return ""
+}
+
+// getMultipathPortals returns a portal for each connected and reachable DSM interface which the target listens on,
+// filtered by the multipath_portals option
+func getMultipathPortals(dsm *webapi.DSM, target webapi.TargetInfo, option string) ([]string, error) {
+	selected, err := parseMultipathPortals(option)
+	if err != nil {
+		return nil, err
+	}
+
+	netIfs, err := dsm.NetworkInterfaceList("")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get DSM[%s] network list: %v", dsm.Ip, err)
+	}
+
+	portals := []string{}
+	for _, netIf := range netIfs {
+		if netIf.Status != "connected" || !isTargetListeningOn(target, netIf.Ifname) {
+			continue
+		}
+
+		ips := netIf.Ips()
+		if selected != nil && !utils.SliceContains(selected, netIf.Ifname) {
+			matched := []string{}
+			for _, ip := range ips {
+				if utils.SliceContains(selected, ip) {
+					matched = append(matched, ip)
+				}
+			}
+			ips = matched
+		}
+
+		ip := getPreferredIp(ips, dsm.IpFamily)
+		if ip == "" {
+			continue
+		}
+
+		if !webapi.CheckIpReachable(ip, ISCSIPort) {
+			log.Warnf("Portal [%s] of DSM[%s] interface [%s] is unreachable, skip it", ip, dsm.Ip, netIf.Ifname)
+			continue
+		}
+		portals = append(portals, getISCSIPortal(ip))
+	}
+
+	if len(portals) == 0 {
+		return nil, fmt.Errorf("No reachable portal of target [%s] matches %q", target.Iqn, option)
+	}
+	return portals, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseMultipathPortals(t *testing.T) {
+	tests := []struct {
+		name    string
+		option  string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", option: "", want: nil},
+		{name: "all", option: "all", want: nil},
+		{name: "all in upper case", option: " ALL ", want: nil},
+		{name: "interfaces", option: "eth0,eth1", want: []string{"eth0", "eth1"}},
+		{name: "ips with spaces", option: "10.0.0.1, 10.0.1.1", want: []string{"10.0.0.1", "10.0.1.1"}},
+		{name: "bracketed ipv6", option: "[fd00::1],fd00::2", want: []string{"fd00::1", "fd00::2"}},
+		{name: "empty item", option: "eth0,,eth1", wantErr: true},
+		{name: "trailing comma", option: "eth0,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMultipathPortals(tt.option)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseMultipathPortals() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMultipathPortals() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
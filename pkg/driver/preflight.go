@@ -0,0 +1,265 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+const (
+	hostRootDir = "/host" // the root of the node mounted in the node plugin, see chroot/chroot.sh
+
+	// iscsid listens on this abstract socket, which is shared with the host network namespace of the node plugin
+	iscsidSocketName = "@ISCSIADM_ABSTRACT_NAMESPACE"
+
+	preflightTimeout = 10 * time.Second
+)
+
+type preflightCheck struct {
+	Name     string
+	Required bool // a failed optional check is only a warning, e.g. multipathd when the volumes have a single portal
+	Run      func() error
+}
+
+type preflightResult struct {
+	Name     string
+	Required bool
+	Err      error
+}
+
+func (r preflightResult) Passed() bool {
+	return r.Err == nil
+}
+
+func checkBinary(name string) func() error {
+	return func() error {
+		_, err := exec.LookPath(name)
+		return err
+	}
+}
+
+// iscsiadm is a wrapper running the binary of the host, so it has to be executed to be checked
+func checkHostBinary(name string, args ...string) func() error {
+	return func() error {
+		if _, err := execWithTimeout(name, args, preflightTimeout); err != nil {
+			return fmt.Errorf("%s is not installed on the host: %v", name, err)
+		}
+		return nil
+	}
+}
+
+// the module is loaded or built in, or can be loaded on demand, e.g. cifs by the first mount
+func checkKernelModule(name string) func() error {
+	return func() error {
+		if _, err := os.Stat(filepath.Join("/sys/module", name)); err == nil {
+			return nil
+		}
+
+		release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+		if err != nil {
+			return err
+		}
+		modulesDir := filepath.Join(hostRootDir, "lib/modules", strings.TrimSpace(string(release)))
+		for _, file := range []string{"modules.dep", "modules.builtin"} {
+			data, err := ioutil.ReadFile(filepath.Join(modulesDir, file))
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				module := strings.SplitN(line, ":", 2)[0]
+				if strings.HasPrefix(filepath.Base(module), name+".ko") {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("Kernel module %s is neither loaded nor found in %s", name, modulesDir)
+	}
+}
+
+func checkIscsid() error {
+	data, err := ioutil.ReadFile("/proc/net/unix")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(data), iscsidSocketName) {
+		return fmt.Errorf("iscsid is not running on the host")
+	}
+	return nil
+}
+
+func checkMultipathd() error {
+	if !MultipathEnabled {
+		return nil
+	}
+	if !multipathd_is_running() {
+		return fmt.Errorf("multipathd is not running on the host, the volumes with several portals are staged without multipath")
+	}
+	return nil
+}
+
+func checkInitiatorName() error {
+	_, err := getInitiatorName(InitiatorNameFile)
+	return err
+}
+
+func preflightChecks() []preflightCheck {
+	return []preflightCheck{
+		{Name: "iscsiadm", Required: true, Run: checkHostBinary("iscsiadm", "--version")},
+		{Name: "iscsid", Required: true, Run: checkIscsid},
+		{Name: "iscsi_tcp", Required: true, Run: checkKernelModule("iscsi_tcp")},
+		{Name: "initiator-name", Required: true, Run: checkInitiatorName},
+		{Name: "multipathd", Required: false, Run: checkMultipathd},
+		{Name: "lsblk", Required: true, Run: checkBinary("lsblk")},
+		{Name: "mount.cifs", Required: true, Run: checkBinary("mount.cifs")},
+		{Name: "cifs", Required: true, Run: checkKernelModule("cifs")},
+	}
+}
+
+// runPreflightChecks checks the node prerequisites, except the ones in PreflightSkip, e.g. the iSCSI checks on SMB-only nodes
+func runPreflightChecks() []preflightResult {
+	results := []preflightResult{}
+	for _, check := range preflightChecks() {
+		if utils.SliceContains(PreflightSkip, check.Name) {
+			continue
+		}
+		results = append(results, preflightResult{
+			Name:     check.Name,
+			Required: check.Required,
+			Err:      check.Run(),
+		})
+	}
+	return results
+}
+
+// preflightError returns the failed required checks
+func preflightError(results []preflightResult) error {
+	failed := []string{}
+	for _, result := range results {
+		if result.Required && !result.Passed() {
+			failed = append(failed, result.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Preflight checks failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func logPreflightResults(results []preflightResult) {
+	for _, result := range results {
+		switch {
+		case result.Passed():
+			log.Infof("Preflight check [%s] passed", result.Name)
+		case result.Required:
+			log.Errorf("Preflight check [%s] failed: %v", result.Name, result.Err)
+		default:
+			log.Warnf("Preflight check [%s] failed: %v", result.Name, result.Err)
+		}
+	}
+}
+
+// RunPreflight runs and logs the preflight checks, and returns an error if any required check fails
+func RunPreflight() error {
+	results := runPreflightChecks()
+	logPreflightResults(results)
+	return preflightError(results)
+}
+
+// preflightChecker re-runs the preflight checks periodically and caches the result for Probe, so the node becomes
+// ready once the prerequisites are fixed, e.g. iscsid started, and not ready if they break later
+type preflightChecker struct {
+	interval time.Duration
+
+	mu      sync.RWMutex
+	results map[string]error // the last error of each check, nil if passed
+	err     error
+}
+
+func newPreflightChecker(interval time.Duration) *preflightChecker {
+	c := &preflightChecker{interval: interval}
+
+	results := runPreflightChecks()
+	logPreflightResults(results)
+	c.update(results)
+	return c
+}
+
+func (c *preflightChecker) Run(stopCh <-chan struct{}) {
+	log.Infof("Preflight checker started, check interval: %v", c.interval)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.update(runPreflightChecks())
+		case <-stopCh:
+			log.Info("Preflight checker stopped")
+			return
+		}
+	}
+}
+
+// update caches the results, and only logs the checks whose result changed since the last run
+func (c *preflightChecker) update(results []preflightResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results != nil {
+		for _, result := range results {
+			lastErr, ok := c.results[result.Name]
+			if !ok || (lastErr == nil) == result.Passed() {
+				continue
+			}
+
+			switch {
+			case result.Passed():
+				log.Infof("Preflight check [%s] passed again", result.Name)
+			case result.Required:
+				log.Errorf("Preflight check [%s] failed: %v", result.Name, result.Err)
+			default:
+				log.Warnf("Preflight check [%s] failed: %v", result.Name, result.Err)
+			}
+		}
+	}
+
+	c.results = make(map[string]error)
+	for _, result := range results {
+		c.results[result.Name] = result.Err
+	}
+	c.err = preflightError(results)
+}
+
+// Err returns the failed required checks of the last run
+func (c *preflightChecker) Err() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.err
+}
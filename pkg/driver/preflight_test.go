@@ -0,0 +1,79 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_preflightError(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []preflightResult
+		want    string
+	}{
+		{
+			name: "all passed",
+			results: []preflightResult{
+				{Name: "iscsiadm", Required: true},
+				{Name: "multipathd"},
+			},
+		},
+		{
+			name: "optional check failed",
+			results: []preflightResult{
+				{Name: "iscsiadm", Required: true},
+				{Name: "multipathd", Err: errors.New("not running")},
+			},
+		},
+		{
+			name: "required checks failed",
+			results: []preflightResult{
+				{Name: "iscsiadm", Required: true, Err: errors.New("not found")},
+				{Name: "multipathd", Err: errors.New("not running")},
+				{Name: "cifs", Required: true, Err: errors.New("not loaded")},
+			},
+			want: "Preflight checks failed: iscsiadm, cifs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := preflightError(tt.results)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("preflightError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_preflightChecker_update(t *testing.T) {
+	c := &preflightChecker{}
+
+	c.update([]preflightResult{{Name: "iscsid", Required: true, Err: errors.New("not running")}})
+	if err := c.Err(); err == nil {
+		t.Errorf("Err() after a failed check = nil, want an error")
+	}
+
+	// the node becomes ready once the prerequisites are fixed
+	c.update([]preflightResult{{Name: "iscsid", Required: true}})
+	if err := c.Err(); err != nil {
+		t.Errorf("Err() after the check passed again = %v, want nil", err)
+	}
+}
+
+func Test_runPreflightChecks_skip(t *testing.T) {
+	defer func(skip []string) { PreflightSkip = skip }(PreflightSkip)
+
+	PreflightSkip = []string{}
+	for _, check := range preflightChecks() {
+		PreflightSkip = append(PreflightSkip, check.Name)
+	}
+	if results := runPreflightChecks(); len(results) != 0 {
+		t.Errorf("runPreflightChecks() = %v, want no result", results)
+	}
+}
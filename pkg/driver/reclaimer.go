@@ -0,0 +1,222 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/metrics"
+)
+
+const (
+	reclaimCheckInterval = 1 * time.Minute
+	fstrimTimeout        = 30 * time.Minute
+)
+
+// e.g. "/var/lib/kubelet/plugins/.../globalmount: 1.2 GiB (1288490188 bytes) trimmed"
+var fstrimOutputRegexp = regexp.MustCompile(`\((\d+) bytes\) trimmed`)
+
+// reclaimState is the fstrim history of a staged thin volume
+type reclaimState struct {
+	VolumeId          string
+	StagingTargetPath string
+	LastRun           time.Time
+	NextRun           time.Time
+	LastReclaimed     int64
+	TotalReclaimed    int64 // bytes returned to the DSM since the node plugin started
+	Err               error
+
+	running bool
+}
+
+// reclaimScheduler periodically runs fstrim on the staged thin-provisioned volumes, so the blocks freed by
+// the filesystem are returned to the thin LUNs on DSM, which are formatted with nodiscard.
+type reclaimScheduler struct {
+	ns       *nodeServer
+	interval time.Duration
+	jitter   time.Duration
+	sem      chan struct{}
+
+	mu     sync.Mutex
+	states map[string]*reclaimState
+}
+
+func newReclaimScheduler(ns *nodeServer, interval time.Duration, jitter time.Duration, concurrency int) *reclaimScheduler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &reclaimScheduler{
+		ns:       ns,
+		interval: interval,
+		jitter:   jitter,
+		sem:      make(chan struct{}, concurrency),
+		states:   make(map[string]*reclaimState),
+	}
+}
+
+func (r *reclaimScheduler) Run(stopCh <-chan struct{}) {
+	log.Infof("Reclaim scheduler started, interval: %v, jitter: %v, concurrency: %d", r.interval, r.jitter, cap(r.sem))
+
+	ticker := time.NewTicker(reclaimCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		r.schedule()
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			log.Info("Reclaim scheduler stopped")
+			return
+		}
+	}
+}
+
+// spread the runs of the volumes over the jitter, so they don't all hit the DSM at once
+func (r *reclaimScheduler) nextRun(from time.Time) time.Time {
+	next := from.Add(r.interval)
+	if r.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(r.jitter))))
+	}
+	return next
+}
+
+func (r *reclaimScheduler) schedule() {
+	records, err := r.ns.stagingStore.List()
+	if err != nil {
+		log.Errorf("Failed to list staging records: %v", err)
+		return
+	}
+
+	now := time.Now()
+	staged := make(map[string]bool)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, record := range records {
+		if !record.Reclaim {
+			continue
+		}
+
+		key := record.VolumeId + "@" + record.StagingTargetPath
+		staged[key] = true
+
+		state, ok := r.states[key]
+		if !ok {
+			// the first run after the volume is staged or the plugin restarts
+			state = &reclaimState{
+				VolumeId:          record.VolumeId,
+				StagingTargetPath: record.StagingTargetPath,
+				NextRun:           r.nextRun(now.Add(-r.interval)),
+			}
+			r.states[key] = state
+		}
+
+		if state.running || now.Before(state.NextRun) {
+			continue
+		}
+
+		state.running = true
+		go r.reclaim(state)
+	}
+
+	for key, state := range r.states {
+		if !staged[key] && !state.running {
+			delete(r.states, key)
+		}
+	}
+}
+
+func (r *reclaimScheduler) reclaim(state *reclaimState) {
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+
+	reclaimed, err := r.fstrimStaged(state.VolumeId, state.StagingTargetPath)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	state.running = false
+	state.LastRun = now
+	state.NextRun = r.nextRun(now)
+	state.Err = err
+
+	if err != nil {
+		log.Errorf("Failed to reclaim volume[%s] on %s: %v", state.VolumeId, state.StagingTargetPath, err)
+		return
+	}
+
+	state.LastReclaimed = reclaimed
+	state.TotalReclaimed += reclaimed
+	metrics.ReclaimedBytes.Add(float64(reclaimed))
+	log.Infof("Reclaimed %d bytes of volume[%s] on %s, %d bytes in total",
+		reclaimed, state.VolumeId, state.StagingTargetPath, state.TotalReclaimed)
+}
+
+// runs fstrim under the volume lock, so the volume isn't unstaged while it is trimmed
+func (r *reclaimScheduler) fstrimStaged(volumeId string, stagingTargetPath string) (int64, error) {
+	r.ns.volumeLocks.LockKey(volumeId)
+	defer r.ns.volumeLocks.UnlockKey(volumeId)
+
+	// the volume may have been unstaged while waiting for its turn
+	if _, err := r.ns.stagingStore.Get(volumeId, stagingTargetPath); err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("Volume is not staged on %s anymore", stagingTargetPath)
+		}
+		return 0, fmt.Errorf("Failed to get staging record: %v", err)
+	}
+
+	return r.fstrim(stagingTargetPath)
+}
+
+// runs fstrim on the mounted filesystem and returns the number of trimmed bytes
+func (r *reclaimScheduler) fstrim(mountPath string) (int64, error) {
+	notMount, err := mount.IsNotMountPoint(r.ns.Mounter.Interface, mountPath)
+	if err != nil {
+		return 0, err
+	}
+	if notMount {
+		return 0, fmt.Errorf("%s is not mounted", mountPath)
+	}
+
+	out, err := execWithTimeout("fstrim", []string{"-v", mountPath}, fstrimTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("fstrim failed: %v", err)
+	}
+
+	return parseFstrimOutput(string(out))
+}
+
+func parseFstrimOutput(out string) (int64, error) {
+	matches := fstrimOutputRegexp.FindStringSubmatch(out)
+	if len(matches) != 2 {
+		return 0, fmt.Errorf("Failed to parse fstrim output: %q", out)
+	}
+	return strconv.ParseInt(matches[1], 10, 64)
+}
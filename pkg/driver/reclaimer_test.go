@@ -0,0 +1,47 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import "testing"
+
+func Test_parseFstrimOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    int64
+		wantErr bool
+	}{
+		{
+			name: "trimmed",
+			out:  "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.san.synology.com/1a2b/globalmount: 1.2 GiB (1288490188 bytes) trimmed\n",
+			want: 1288490188,
+		},
+		{
+			name: "nothing trimmed",
+			out:  "/mnt: 0 B (0 bytes) trimmed",
+			want: 0,
+		},
+		{
+			name:    "not supported",
+			out:     "fstrim: /mnt: the discard operation is not supported",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			out:     "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFstrimOutput(tt.out)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFstrimOutput() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseFstrimOutput() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
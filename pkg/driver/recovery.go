@@ -0,0 +1,89 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// recoverStagedVolumes reconciles the staging journal with the node once at startup, before any request is served,
+// so the volumes staged before a restart can be unstaged, expanded and reported without DSM access
+func (ns *nodeServer) recoverStagedVolumes() {
+	ns.stagingStore.RemoveTempFiles()
+	ns.ephemeralStore.RemoveTempFiles()
+
+	records, err := ns.stagingStore.List()
+	if err != nil {
+		log.Errorf("Failed to list staging records: %v", err)
+		return
+	}
+
+	recovered := 0
+	for _, record := range records {
+		if err := ns.recoverStagedVolume(record); err != nil {
+			log.Errorf("Failed to recover staged volume[%s] on %s: %v", record.VolumeId, record.StagingTargetPath, err)
+			continue
+		}
+		recovered++
+	}
+
+	log.Infof("Recovered %d/%d staged volumes from the staging journal", recovered, len(records))
+}
+
+func (ns *nodeServer) recoverStagedVolume(record *stagingRecord) error {
+	ns.volumeLocks.LockKey(record.VolumeId)
+	defer ns.volumeLocks.UnlockKey(record.VolumeId)
+
+	// kubelet removes the staging path once the volume is unstaged, so the node plugin died in the middle of
+	// NodeUnstageVolume, or the path was cleaned up while it was down. Release what is left of the volume.
+	if _, err := os.Stat(record.StagingTargetPath); os.IsNotExist(err) {
+		log.Infof("Volume[%s] staging path %s is gone, release the volume", record.VolumeId, record.StagingTargetPath)
+		return ns.releaseStagedVolume(context.Background(), record)
+	}
+
+	if record.Protocol != utils.ProtocolIscsi {
+		return nil
+	}
+
+	if record.DevicePath != "" {
+		if exists, _ := mount.PathExists(record.DevicePath); exists {
+			return nil
+		}
+	}
+
+	// no session after a node reboot, which is logged in again by the session supervisor or the next NodeStageVolume
+	if !hasSession(record.TargetIqn, "") {
+		log.Infof("Volume[%s] has no session of target [%s] yet", record.VolumeId, record.TargetIqn)
+		return nil
+	}
+
+	// the multipath device may be renamed when the sessions are re-established
+	devicePath := getExistedVolumeMountPath(record.TargetIqn, record.MappingIndex)
+	if devicePath == "" || devicePath == record.DevicePath {
+		return nil
+	}
+
+	log.Infof("Volume[%s] device is changed from [%s] to [%s]", record.VolumeId, record.DevicePath, devicePath)
+	record.DevicePath = devicePath
+	return ns.stagingStore.Save(record)
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/utils/keymutex"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func Test_nodeServer_recoverStagedVolumes(t *testing.T) {
+	dir := t.TempDir()
+	stagedPath := filepath.Join(dir, "staged")
+	devicePath := filepath.Join(dir, "dm-0")
+	if err := os.Mkdir(stagedPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(devicePath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &nodeServer{
+		stagingStore:   newStagingStore(filepath.Join(dir, "records")),
+		ephemeralStore: newStagingStore(filepath.Join(dir, "records", "ephemeral")),
+		volumeLocks:    keymutex.NewHashed(0),
+		targetLocks:    keymutex.NewHashed(0),
+	}
+
+	iqn := "iqn.2000-01.com.synology:dsm.csi-vol-1"
+	kept := []*stagingRecord{
+		{VolumeId: "vol-1", Protocol: utils.ProtocolIscsi, StagingTargetPath: stagedPath, TargetIqn: iqn, DevicePath: devicePath},
+		{VolumeId: "vol-2", Protocol: utils.ProtocolSmb, StagingTargetPath: stagedPath, ShareName: "share-2"},
+	}
+	// the node plugin died in NodeUnstageVolume after kubelet removed the staging paths
+	released := []*stagingRecord{
+		{VolumeId: "vol-1", Protocol: utils.ProtocolIscsi, StagingTargetPath: filepath.Join(dir, "gone-1"), TargetIqn: iqn},
+		{VolumeId: "vol-3", Protocol: utils.ProtocolSmb, StagingTargetPath: filepath.Join(dir, "gone-3"), ShareName: "share-3"},
+	}
+	for _, record := range append(kept, released...) {
+		if err := ns.stagingStore.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpPath := ns.stagingStore.recordPath("vol-4", stagedPath) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ns.recoverStagedVolumes()
+
+	for _, record := range kept {
+		if _, err := ns.stagingStore.Get(record.VolumeId, record.StagingTargetPath); err != nil {
+			t.Errorf("record of volume[%s] at %s error = %v, want kept", record.VolumeId, record.StagingTargetPath, err)
+		}
+	}
+	for _, record := range released {
+		if _, err := ns.stagingStore.Get(record.VolumeId, record.StagingTargetPath); !os.IsNotExist(err) {
+			t.Errorf("record of volume[%s] at %s error = %v, want released", record.VolumeId, record.StagingTargetPath, err)
+		}
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("partial record stat error = %v, want removed", err)
+	}
+}
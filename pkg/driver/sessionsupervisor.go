@@ -0,0 +1,220 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// sessionState is the result of the last reconciliation of a staged iSCSI volume
+type sessionState struct {
+	VolumeId          string
+	StagingTargetPath string
+	TargetIqn         string
+	Portals           int
+	ActiveSessions    int
+	Repaired          int // total number of sessions re-established since the node plugin started
+	LastCheck         time.Time
+	Err               error
+}
+
+func (state sessionState) Healthy() bool {
+	return state.Err == nil && state.ActiveSessions == state.Portals
+}
+
+// sessionSupervisor periodically reconciles the staged iSCSI volumes against
+// `iscsiadm -m session`, and logs in again to the portals whose session was dropped,
+// e.g. after a DSM reboot or a network path flap.
+type sessionSupervisor struct {
+	ns       *nodeServer
+	interval time.Duration
+
+	mu     sync.RWMutex
+	states map[sessionKey]*sessionState
+}
+
+// keyed like the staging records, each staging path of a volume has its own sessions record
+type sessionKey struct {
+	volumeId          string
+	stagingTargetPath string
+}
+
+func newSessionSupervisor(ns *nodeServer, interval time.Duration) *sessionSupervisor {
+	return &sessionSupervisor{
+		ns:       ns,
+		interval: interval,
+		states:   make(map[sessionKey]*sessionState),
+	}
+}
+
+func (s *sessionSupervisor) Run(stopCh <-chan struct{}) {
+	log.Infof("iSCSI session supervisor started, check interval: %v", s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.reconcile()
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			log.Info("iSCSI session supervisor stopped")
+			return
+		}
+	}
+}
+
+// GetState returns the last reconciliation result of the volume staged on the staging path
+func (s *sessionSupervisor) GetState(volumeId string, stagingTargetPath string) (sessionState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state, ok := s.states[sessionKey{volumeId, stagingTargetPath}]
+	if !ok {
+		return sessionState{}, false
+	}
+	return *state, true
+}
+
+func (s *sessionSupervisor) reconcile() {
+	records, err := s.ns.stagingStore.List()
+	if err != nil {
+		log.Errorf("Failed to list staging records: %v", err)
+		return
+	}
+
+	supervised := make(map[sessionKey]bool)
+	for _, record := range records {
+		if record.Protocol != utils.ProtocolIscsi {
+			continue
+		}
+		supervised[sessionKey{record.VolumeId, record.StagingTargetPath}] = true
+		s.reconcileVolume(record.VolumeId, record.StagingTargetPath)
+	}
+
+	s.mu.Lock()
+	for key := range s.states {
+		if !supervised[key] {
+			delete(s.states, key)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *sessionSupervisor) reconcileVolume(volumeId string, stagingTargetPath string) {
+	s.ns.volumeLocks.LockKey(volumeId)
+	defer s.ns.volumeLocks.UnlockKey(volumeId)
+
+	// the volume may have been unstaged while waiting for the lock
+	record, err := s.ns.stagingStore.Get(volumeId, stagingTargetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to get staging record of volume[%s]: %v", volumeId, err)
+		}
+		return
+	}
+
+	key := sessionKey{volumeId, stagingTargetPath}
+	s.mu.Lock()
+	state, ok := s.states[key]
+	if !ok {
+		state = &sessionState{
+			VolumeId:          volumeId,
+			StagingTargetPath: stagingTargetPath,
+			TargetIqn:         record.TargetIqn,
+		}
+		s.states[key] = state
+	}
+	s.mu.Unlock()
+
+	s.ns.targetLocks.LockKey(record.TargetIqn)
+	repaired, active, err := s.repairSessions(record)
+	s.ns.targetLocks.UnlockKey(record.TargetIqn)
+
+	s.mu.Lock()
+	state.Portals = len(record.Portals)
+	state.ActiveSessions = active
+	state.Repaired += repaired
+	state.LastCheck = time.Now()
+	state.Err = err
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("Volume[%s] has %d/%d iSCSI sessions of target [%s]: %v", volumeId, active, len(record.Portals), record.TargetIqn, err)
+	} else if repaired > 0 {
+		log.Infof("Volume[%s] re-established %d iSCSI sessions of target [%s]", volumeId, repaired, record.TargetIqn)
+	}
+}
+
+// re-login the missing portals of the record, returns the number of repaired and active sessions
+func (s *sessionSupervisor) repairSessions(record *stagingRecord) (int, int, error) {
+	sessions := iscsiadm_session()
+	isMultipath := len(record.Portals) > 1 && IsMultipathEnabled()
+
+	var lastErr error
+	repaired, active := 0, 0
+	for _, portal := range record.Portals {
+		if findSession(sessions, record.TargetIqn, portal) {
+			active++
+			continue
+		}
+
+		log.Warnf("Session of target [%s] on portal [%s] is missing, going to login again", record.TargetIqn, portal)
+		if err := s.ns.Initiator.login(context.Background(), record.TargetIqn, portal); err != nil {
+			lastErr = fmt.Errorf("Failed to login portal [%s]: %v", portal, err)
+			continue
+		}
+
+		if isMultipath {
+			if err := readdMultipathPath(getISCSIDevicePath(portal, record.TargetIqn, record.MappingIndex)); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+
+		repaired++
+		active++
+	}
+
+	return repaired, active, lastErr
+}
+
+func readdMultipathPath(devPath string) error {
+	if err := waitForDevicePathToExist(devPath); err != nil {
+		return fmt.Errorf("Can't find device path [%s]: %v", devPath, err)
+	}
+
+	realPath, err := filepath.EvalSymlinks(devPath)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve device path [%s]: %v", devPath, err)
+	}
+
+	if err := multipath_add_path(filepath.Base(realPath)); err != nil {
+		return fmt.Errorf("Failed to add path [%s] to multipath device: %v", realPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// The permissions of the local users granted by the nodes are tracked in a ConfigMap of each share in
+// SmbGrantsNamespace, whose data maps the node ID to the granted users, one per line. The permission of a user is
+// only revoked when the last node using it unstages the share.
+const (
+	smbGrantsNamePrefix      = "synology-csi-smb-grants-"
+	smbGrantsShareAnnotation = DriverName + "/share"
+)
+
+func smbGrantsName(dsmIp string, shareName string) string {
+	return smbGrantsNamePrefix + shortHash(smbShareLockKey(dsmIp, shareName), 16)
+}
+
+func parseSmbGrantUsers(value string) []string {
+	users := []string{}
+	for _, user := range strings.Split(value, "\n") {
+		if user != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// addSmbGrant records the user granted by the node, false if it is already recorded
+func addSmbGrant(grants map[string]string, nodeId string, userName string) bool {
+	users := parseSmbGrantUsers(grants[nodeId])
+	for _, user := range users {
+		if strings.EqualFold(user, userName) {
+			return false
+		}
+	}
+	grants[nodeId] = strings.Join(append(users, userName), "\n")
+	return true
+}
+
+// removeSmbGrant removes the user granted by the node, false if it isn't recorded
+func removeSmbGrant(grants map[string]string, nodeId string, userName string) bool {
+	users := parseSmbGrantUsers(grants[nodeId])
+	remaining := []string{}
+	for _, user := range users {
+		if !strings.EqualFold(user, userName) {
+			remaining = append(remaining, user)
+		}
+	}
+	if len(remaining) == len(users) {
+		return false
+	}
+
+	if len(remaining) == 0 {
+		delete(grants, nodeId)
+	} else {
+		grants[nodeId] = strings.Join(remaining, "\n")
+	}
+	return true
+}
+
+// isSmbUserGranted tells if any node has granted the user
+func isSmbUserGranted(grants map[string]string, userName string) bool {
+	for _, value := range grants {
+		for _, user := range parseSmbGrantUsers(value) {
+			if strings.EqualFold(user, userName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// updateSmbGrants applies update to the grants of the share, and saves them if update returns true.
+// The ConfigMap is written with the resource version it was read at, so update is called again with the new grants
+// if another node has changed them meanwhile, and the ConfigMap is deleted once no grant is left.
+func updateSmbGrants(ctx context.Context, client kubernetes.Interface, dsmIp string, shareName string,
+	update func(grants map[string]string) (bool, error)) error {
+	name := smbGrantsName(dsmIp, shareName)
+	configMaps := client.CoreV1().ConfigMaps(SmbGrantsNamespace)
+
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) || apierrors.IsNotFound(err)
+	}
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		configMap, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		exists := err == nil
+		if apierrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   SmbGrantsNamespace,
+					Labels:      map[string]string{"app.kubernetes.io/managed-by": DriverName},
+					Annotations: map[string]string{smbGrantsShareAnnotation: smbShareLockKey(dsmIp, shareName)},
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+
+		changed, err := update(configMap.Data)
+		if err != nil || !changed {
+			return err
+		}
+
+		switch {
+		case !exists && len(configMap.Data) == 0:
+			return nil
+		case !exists:
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		case len(configMap.Data) == 0:
+			err = configMaps.Delete(ctx, name, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &configMap.ResourceVersion},
+			})
+		default:
+			_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		}
+		return err
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_addSmbGrant(t *testing.T) {
+	tests := []struct {
+		name       string
+		grants     map[string]string
+		nodeId     string
+		userName   string
+		want       bool
+		wantGrants map[string]string
+	}{
+		{name: "first", grants: map[string]string{}, nodeId: "node-1", userName: "alice", want: true, wantGrants: map[string]string{"node-1": "alice"}},
+		{name: "another user", grants: map[string]string{"node-1": "alice"}, nodeId: "node-1", userName: "bob", want: true, wantGrants: map[string]string{"node-1": "alice\nbob"}},
+		{name: "another node", grants: map[string]string{"node-1": "alice"}, nodeId: "node-2", userName: "alice", want: true, wantGrants: map[string]string{"node-1": "alice", "node-2": "alice"}},
+		{name: "recorded", grants: map[string]string{"node-1": "alice"}, nodeId: "node-1", userName: "Alice", want: false, wantGrants: map[string]string{"node-1": "alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addSmbGrant(tt.grants, tt.nodeId, tt.userName); got != tt.want {
+				t.Errorf("addSmbGrant() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.grants, tt.wantGrants) {
+				t.Errorf("addSmbGrant() grants = %v, want %v", tt.grants, tt.wantGrants)
+			}
+		})
+	}
+}
+
+func Test_removeSmbGrant(t *testing.T) {
+	tests := []struct {
+		name       string
+		grants     map[string]string
+		nodeId     string
+		userName   string
+		want       bool
+		wantGrants map[string]string
+	}{
+		{name: "last", grants: map[string]string{"node-1": "alice"}, nodeId: "node-1", userName: "alice", want: true, wantGrants: map[string]string{}},
+		{name: "one of users", grants: map[string]string{"node-1": "alice\nbob"}, nodeId: "node-1", userName: "ALICE", want: true, wantGrants: map[string]string{"node-1": "bob"}},
+		{name: "other node kept", grants: map[string]string{"node-1": "alice", "node-2": "alice"}, nodeId: "node-1", userName: "alice", want: true, wantGrants: map[string]string{"node-2": "alice"}},
+		{name: "not recorded", grants: map[string]string{"node-2": "alice"}, nodeId: "node-1", userName: "alice", want: false, wantGrants: map[string]string{"node-2": "alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := removeSmbGrant(tt.grants, tt.nodeId, tt.userName); got != tt.want {
+				t.Errorf("removeSmbGrant() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.grants, tt.wantGrants) {
+				t.Errorf("removeSmbGrant() grants = %v, want %v", tt.grants, tt.wantGrants)
+			}
+		})
+	}
+}
+
+func Test_isSmbUserGranted(t *testing.T) {
+	grants := map[string]string{"node-1": "alice", "node-2": "bob\ncarol"}
+	tests := []struct {
+		name     string
+		userName string
+		want     bool
+	}{
+		{name: "granted", userName: "alice", want: true},
+		{name: "case insensitive", userName: "Carol", want: true},
+		{name: "not granted", userName: "dave", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSmbUserGranted(grants, tt.userName); got != tt.want {
+				t.Errorf("isSmbUserGranted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_smbGrantsName(t *testing.T) {
+	if smbGrantsName("10.0.0.1", "pvc-1") == smbGrantsName("10.0.0.2", "pvc-1") {
+		t.Errorf("smbGrantsName() is the same for the shares of different DSMs")
+	}
+}
+
+func Test_updateSmbGrants(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	name := smbGrantsName("10.0.0.1", "pvc-1")
+
+	add := func(nodeId string) func(map[string]string) (bool, error) {
+		return func(grants map[string]string) (bool, error) {
+			return addSmbGrant(grants, nodeId, "alice"), nil
+		}
+	}
+	remove := func(nodeId string) func(map[string]string) (bool, error) {
+		return func(grants map[string]string) (bool, error) {
+			return removeSmbGrant(grants, nodeId, "alice"), nil
+		}
+	}
+
+	steps := []struct {
+		name     string
+		update   func(map[string]string) (bool, error)
+		wantData map[string]string // nil if the ConfigMap is deleted
+	}{
+		{name: "create", update: add("node-1"), wantData: map[string]string{"node-1": "alice"}},
+		{name: "update", update: add("node-2"), wantData: map[string]string{"node-1": "alice", "node-2": "alice"}},
+		{name: "unchanged", update: add("node-2"), wantData: map[string]string{"node-1": "alice", "node-2": "alice"}},
+		{name: "remove", update: remove("node-1"), wantData: map[string]string{"node-2": "alice"}},
+		{name: "delete", update: remove("node-2"), wantData: nil},
+		{name: "nothing to remove", update: remove("node-2"), wantData: nil},
+	}
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := updateSmbGrants(ctx, client, "10.0.0.1", "pvc-1", tt.update); err != nil {
+				t.Fatalf("updateSmbGrants() error = %v", err)
+			}
+
+			configMap, err := client.CoreV1().ConfigMaps(SmbGrantsNamespace).Get(ctx, name, metav1.GetOptions{})
+			if tt.wantData == nil {
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("updateSmbGrants() ConfigMap exists, error = %v, want deleted", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if !reflect.DeepEqual(configMap.Data, tt.wantData) {
+				t.Errorf("updateSmbGrants() data = %v, want %v", configMap.Data, tt.wantData)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// StorageClass parameters of the CIFS mounts, passed to the node in VolumeContext
+const (
+	smbVersionKey      = "smb_version"
+	smbSealKey         = "smb_seal"
+	smbMultichannelKey = "smb_multichannel"
+	smbMaxChannelsKey  = "smb_max_channels"
+	smbCacheKey        = "smb_cache"
+	smbActimeoKey      = "smb_actimeo"
+	smbUidKey          = "smb_uid"
+	smbFileModeKey     = "smb_file_mode"
+	smbDirModeKey      = "smb_dir_mode"
+	smbSecurityKey     = "smb_security"
+	smbKrb5ServerKey   = "smb_krb5_server"
+
+	// controller only, the AD principals granted read-write permission of the share
+	smbDomainUsersKey  = "smb_domain_users"
+	smbDomainGroupsKey = "smb_domain_groups"
+
+	smbSecurityNtlmssp = "ntlmssp" // username and password of the node-stage secret
+	smbSecurityKrb5    = "krb5"    // Kerberos ticket of the principal of the node-stage secret
+
+	// negotiates the highest SMB3 dialect supported by both sides, recorded in the VolumeContext of the new volumes
+	defaultSmbVersion = "3"
+	maxSmbChannels    = 16
+)
+
+var smbOptionKeys = []string{smbVersionKey, smbSealKey, smbMultichannelKey, smbMaxChannelsKey, smbCacheKey,
+	smbActimeoKey, smbUidKey, smbFileModeKey, smbDirModeKey, smbSecurityKey, smbKrb5ServerKey}
+
+// only the dialects supporting encryption are allowed for the sealed mounts, SMB1 and SMB2 can't seal the traffic
+var smbVersions = []string{"3", "3.0", "3.02", "3.1.1"}
+
+// the dialects allowed if smb_seal is disabled, see SmbAllowUnsealed
+var smbUnsealedVersions = []string{"2.0", "2.1", "3", "3.0", "3.02", "3.1.1"}
+
+var smbCacheModes = []string{"strict", "none", "loose", "singleclient", "ro"}
+
+type smbOptions struct {
+	Version      string // empty if smb_version isn't given, e.g. the PVs created before the SMB options
+	Seal         bool   // the share requires SMB3 encryption, always true unless SmbAllowUnsealed
+	SealOption   bool   // mount with the seal option, only if smb_seal is given, so the PVs created before it keep their options
+	Multichannel bool
+	MaxChannels  int
+	Cache        string
+	Actimeo      *int
+	Uid          string
+	FileMode     string
+	DirMode      string
+	Security     string
+	Krb5Server   string
+}
+
+// parseSmbOptions parses and validates the SMB options in the parameters
+func parseSmbOptions(params map[string]string) (*smbOptions, error) {
+	opts := &smbOptions{Seal: true, Security: smbSecurityNtlmssp}
+
+	if params[smbSealKey] != "" {
+		seal, err := strconv.ParseBool(params[smbSealKey])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %q", smbSealKey, params[smbSealKey])
+		}
+		if !seal && !SmbAllowUnsealed {
+			return nil, fmt.Errorf("%s is not allowed to be disabled, unsealed SMB is disabled by the driver", smbSealKey)
+		}
+		opts.Seal = seal
+		opts.SealOption = true
+	}
+
+	if params[smbVersionKey] != "" {
+		if opts.Seal && !utils.SliceContains(smbVersions, params[smbVersionKey]) {
+			return nil, fmt.Errorf("Invalid %s: %q, only SMB3 %v is allowed unless %s is disabled", smbVersionKey, params[smbVersionKey], smbVersions, smbSealKey)
+		}
+		if !utils.SliceContains(smbUnsealedVersions, params[smbVersionKey]) {
+			return nil, fmt.Errorf("Invalid %s: %q, must be one of %v", smbVersionKey, params[smbVersionKey], smbUnsealedVersions)
+		}
+		opts.Version = params[smbVersionKey]
+	}
+
+	if params[smbMultichannelKey] != "" {
+		multichannel, err := strconv.ParseBool(params[smbMultichannelKey])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %q", smbMultichannelKey, params[smbMultichannelKey])
+		}
+		opts.Multichannel = multichannel
+	}
+
+	if params[smbMaxChannelsKey] != "" {
+		maxChannels, err := strconv.Atoi(params[smbMaxChannelsKey])
+		if err != nil || maxChannels < 1 || maxChannels > maxSmbChannels {
+			return nil, fmt.Errorf("Invalid %s: %q, must be 1 to %d", smbMaxChannelsKey, params[smbMaxChannelsKey], maxSmbChannels)
+		}
+		if !opts.Multichannel {
+			return nil, fmt.Errorf("%s requires %s", smbMaxChannelsKey, smbMultichannelKey)
+		}
+		opts.MaxChannels = maxChannels
+	}
+
+	if params[smbCacheKey] != "" {
+		if !utils.SliceContains(smbCacheModes, params[smbCacheKey]) {
+			return nil, fmt.Errorf("Invalid %s: %q, must be one of %v", smbCacheKey, params[smbCacheKey], smbCacheModes)
+		}
+		opts.Cache = params[smbCacheKey]
+	}
+
+	if params[smbActimeoKey] != "" {
+		actimeo, err := strconv.Atoi(params[smbActimeoKey])
+		if err != nil || actimeo < 0 {
+			return nil, fmt.Errorf("Invalid %s: %q, must be a non-negative number of seconds", smbActimeoKey, params[smbActimeoKey])
+		}
+		opts.Actimeo = &actimeo
+	}
+
+	if params[smbUidKey] != "" {
+		if _, err := strconv.ParseUint(params[smbUidKey], 10, 32); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %q", smbUidKey, params[smbUidKey])
+		}
+		opts.Uid = params[smbUidKey]
+	}
+
+	if params[smbFileModeKey] != "" {
+		if !isFileMode(params[smbFileModeKey]) {
+			return nil, fmt.Errorf("Invalid %s: %q, must be an octal mode, e.g. 0644", smbFileModeKey, params[smbFileModeKey])
+		}
+		opts.FileMode = params[smbFileModeKey]
+	}
+
+	if params[smbDirModeKey] != "" {
+		if !isFileMode(params[smbDirModeKey]) {
+			return nil, fmt.Errorf("Invalid %s: %q, must be an octal mode, e.g. 0755", smbDirModeKey, params[smbDirModeKey])
+		}
+		opts.DirMode = params[smbDirModeKey]
+	}
+
+	if params[smbSecurityKey] != "" {
+		if params[smbSecurityKey] != smbSecurityNtlmssp && params[smbSecurityKey] != smbSecurityKrb5 {
+			return nil, fmt.Errorf("Invalid %s: %q, must be %s or %s", smbSecurityKey, params[smbSecurityKey], smbSecurityNtlmssp, smbSecurityKrb5)
+		}
+		opts.Security = params[smbSecurityKey]
+	}
+
+	if params[smbKrb5ServerKey] != "" {
+		if opts.Security != smbSecurityKrb5 {
+			return nil, fmt.Errorf("%s requires %s %s", smbKrb5ServerKey, smbSecurityKey, smbSecurityKrb5)
+		}
+		opts.Krb5Server = strings.TrimSpace(params[smbKrb5ServerKey])
+	}
+
+	return opts, nil
+}
+
+// setSmbVolumeContext records smb_seal and smb_version of a new volume, so the node mounts it with the seal and vers options
+func setSmbVolumeContext(volumeContext map[string]string, opts *smbOptions) {
+	volumeContext[smbSealKey] = strconv.FormatBool(opts.Seal)
+	volumeContext[smbVersionKey] = defaultSmbVersion
+	if opts.Version != "" {
+		volumeContext[smbVersionKey] = opts.Version
+	}
+}
+
+// parseSmbPrincipals parses the comma-separated AD users or groups, e.g. "EXAMPLE\\alice,EXAMPLE\\bob"
+func parseSmbPrincipals(key string, value string) ([]string, error) {
+	principals := []string{}
+	if value == "" {
+		return principals, nil
+	}
+
+	for _, principal := range strings.Split(value, ",") {
+		principal = strings.TrimSpace(principal)
+		if principal == "" {
+			return nil, fmt.Errorf("Invalid %s: %q", key, value)
+		}
+		principals = append(principals, principal)
+	}
+	return principals, nil
+}
+
+func isFileMode(mode string) bool {
+	v, err := strconv.ParseUint(mode, 8, 32)
+	return err == nil && v <= 07777
+}
+
+func getMountOptionName(option string) string {
+	return strings.SplitN(strings.TrimSpace(option), "=", 2)[0]
+}
+
+func splitMountFlags(mountFlags []string) []string {
+	options := []string{}
+	for _, flag := range mountFlags {
+		options = append(options, strings.Split(flag, ",")...)
+	}
+	return options
+}
+
+// validateSmbMountFlags rejects the mountOptions of the StorageClass which would mount the share without SMB3 encryption,
+// nothing is rejected if the mounts are not sealed
+func validateSmbMountFlags(mountFlags []string, seal bool) error {
+	if !seal {
+		return nil
+	}
+
+	for _, option := range splitMountFlags(mountFlags) {
+		switch getMountOptionName(option) {
+		case "vers":
+			version := strings.TrimPrefix(strings.TrimSpace(option), "vers=")
+			if !utils.SliceContains(smbVersions, version) {
+				return fmt.Errorf("Mount option %q is not allowed, only SMB3 %v is allowed", option, smbVersions)
+			}
+		case "sec":
+			if strings.TrimSpace(option) == "sec=none" {
+				return fmt.Errorf("Mount option %q is not allowed, the session can't be encrypted", option)
+			}
+		}
+	}
+	return nil
+}
+
+// MountOptions returns the CIFS mount options, the traffic is sealed with SMB3 encryption unless smb_seal is disabled.
+// The seal and vers options are only added if smb_seal and smb_version are given, the PVs created before them keep
+// their mount options and are sealed by the encryption required by the share.
+// The options given in the mountOptions of the StorageClass take precedence over the parameters.
+func (opts *smbOptions) MountOptions(mountFlags []string) []string {
+	given := map[string]bool{}
+	for _, option := range splitMountFlags(mountFlags) {
+		given[getMountOptionName(option)] = true
+	}
+
+	options := []string{}
+	add := func(name string, option string) {
+		if !given[name] {
+			options = append(options, option)
+		}
+	}
+
+	if opts.Seal && opts.SealOption {
+		add("seal", "seal")
+	}
+	if opts.Security == smbSecurityKrb5 {
+		add("sec", "sec=krb5")
+	}
+	if opts.Version != "" {
+		add("vers", "vers="+opts.Version)
+	}
+	if opts.Multichannel {
+		add("multichannel", "multichannel")
+		if opts.MaxChannels != 0 {
+			add("max_channels", fmt.Sprintf("max_channels=%d", opts.MaxChannels))
+		}
+	}
+	if opts.Cache != "" {
+		add("cache", "cache="+opts.Cache)
+	}
+	if opts.Actimeo != nil {
+		add("actimeo", fmt.Sprintf("actimeo=%d", *opts.Actimeo))
+	}
+	if opts.Uid != "" && !given["uid"] {
+		options = append(options, "uid="+opts.Uid, "forceuid")
+	}
+	if opts.FileMode != "" {
+		add("file_mode", "file_mode="+opts.FileMode)
+	}
+	if opts.DirMode != "" {
+		add("dir_mode", "dir_mode="+opts.DirMode)
+	}
+
+	return options
+}
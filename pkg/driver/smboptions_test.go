@@ -0,0 +1,219 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseSmbOptions(t *testing.T) {
+	actimeo := 30
+	tests := []struct {
+		name          string
+		params        map[string]string
+		allowUnsealed bool
+		want          *smbOptions
+		wantErr       bool
+	}{
+		{
+			name:   "default",
+			params: map[string]string{},
+			want:   &smbOptions{Seal: true, Security: smbSecurityNtlmssp},
+		},
+		{
+			name:   "sealed",
+			params: map[string]string{smbSealKey: "true"},
+			want:   &smbOptions{Seal: true, SealOption: true, Security: smbSecurityNtlmssp},
+		},
+		{
+			name: "all options",
+			params: map[string]string{
+				smbVersionKey:      "3.1.1",
+				smbMultichannelKey: "true",
+				smbMaxChannelsKey:  "4",
+				smbCacheKey:        "loose",
+				smbActimeoKey:      "30",
+				smbUidKey:          "1000",
+				smbFileModeKey:     "0644",
+				smbDirModeKey:      "0755",
+				smbSecurityKey:     smbSecurityKrb5,
+				smbKrb5ServerKey:   " dsm.example.com ",
+			},
+			want: &smbOptions{
+				Version:      "3.1.1",
+				Seal:         true,
+				Multichannel: true,
+				MaxChannels:  4,
+				Cache:        "loose",
+				Actimeo:      &actimeo,
+				Uid:          "1000",
+				FileMode:     "0644",
+				DirMode:      "0755",
+				Security:     smbSecurityKrb5,
+				Krb5Server:   "dsm.example.com",
+			},
+		},
+		{
+			name:    "unsealed not allowed",
+			params:  map[string]string{smbSealKey: "false"},
+			wantErr: true,
+		},
+		{
+			name:          "unsealed SMB2",
+			params:        map[string]string{smbSealKey: "false", smbVersionKey: "2.1"},
+			allowUnsealed: true,
+			want:          &smbOptions{Version: "2.1", Seal: false, SealOption: true, Security: smbSecurityNtlmssp},
+		},
+		{
+			name:    "sealed SMB2",
+			params:  map[string]string{smbVersionKey: "2.1"},
+			wantErr: true,
+		},
+		{
+			name:          "unsealed SMB1",
+			params:        map[string]string{smbSealKey: "false", smbVersionKey: "1.0"},
+			allowUnsealed: true,
+			wantErr:       true,
+		},
+		{
+			name:    "invalid seal",
+			params:  map[string]string{smbSealKey: "maybe"},
+			wantErr: true,
+		},
+		{
+			name:    "max channels without multichannel",
+			params:  map[string]string{smbMaxChannelsKey: "4"},
+			wantErr: true,
+		},
+		{
+			name:    "too many channels",
+			params:  map[string]string{smbMultichannelKey: "true", smbMaxChannelsKey: "17"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cache",
+			params:  map[string]string{smbCacheKey: "fast"},
+			wantErr: true,
+		},
+		{
+			name:    "negative actimeo",
+			params:  map[string]string{smbActimeoKey: "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid file mode",
+			params:  map[string]string{smbFileModeKey: "0999"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid security",
+			params:  map[string]string{smbSecurityKey: "none"},
+			wantErr: true,
+		},
+		{
+			name:    "krb5 server without krb5",
+			params:  map[string]string{smbKrb5ServerKey: "dsm.example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SmbAllowUnsealed = tt.allowUnsealed
+			defer func() { SmbAllowUnsealed = false }()
+
+			got, err := parseSmbOptions(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSmbOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSmbOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateSmbMountFlags(t *testing.T) {
+	type args struct {
+		mountFlags []string
+		seal       bool
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{name: "no flags", args: args{seal: true}},
+		{name: "SMB3", args: args{mountFlags: []string{"vers=3.1.1", "nobrl"}, seal: true}},
+		{name: "SMB2 in a list", args: args{mountFlags: []string{"nobrl,vers=2.1"}, seal: true}, wantErr: true},
+		{name: "sec=none", args: args{mountFlags: []string{"sec=none"}, seal: true}, wantErr: true},
+		{name: "sec=krb5", args: args{mountFlags: []string{"sec=krb5"}, seal: true}},
+		{name: "unsealed SMB2", args: args{mountFlags: []string{"vers=2.1", "sec=none"}, seal: false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSmbMountFlags(tt.args.mountFlags, tt.args.seal); (err != nil) != tt.wantErr {
+				t.Errorf("validateSmbMountFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_smbOptions_MountOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       *smbOptions
+		mountFlags []string
+		want       []string
+	}{
+		{
+			name: "created before the SMB options",
+			opts: &smbOptions{Seal: true, Security: smbSecurityNtlmssp},
+			want: []string{},
+		},
+		{
+			name: "sealed",
+			opts: &smbOptions{Version: "3.1.1", Seal: true, SealOption: true, Security: smbSecurityNtlmssp},
+			want: []string{"seal", "vers=3.1.1"},
+		},
+		{
+			name: "unsealed",
+			opts: &smbOptions{Version: "2.1", Seal: false, SealOption: true, Security: smbSecurityNtlmssp},
+			want: []string{"vers=2.1"},
+		},
+		{
+			name:       "given in mount flags",
+			opts:       &smbOptions{Version: "3", Seal: true, SealOption: true, Security: smbSecurityKrb5, Uid: "1000"},
+			mountFlags: []string{"vers=3.1.1,uid=0"},
+			want:       []string{"seal", "sec=krb5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.MountOptions(tt.mountFlags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("smbOptions.MountOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_setSmbVolumeContext(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *smbOptions
+		want map[string]string
+	}{
+		{name: "default", opts: &smbOptions{Seal: true}, want: map[string]string{smbSealKey: "true", smbVersionKey: defaultSmbVersion}},
+		{name: "unsealed", opts: &smbOptions{Version: "2.1", Seal: false}, want: map[string]string{smbSealKey: "false", smbVersionKey: "2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+			setSmbVolumeContext(got, tt.opts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("setSmbVolumeContext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
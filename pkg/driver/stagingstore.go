@@ -0,0 +1,188 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stagingRecord describes a volume staged on this node. It is persisted on disk,
+// so the node plugin can find its iSCSI sessions again after a restart.
+type stagingRecord struct {
+	VolumeId          string   `json:"volume_id"`
+	Protocol          string   `json:"protocol"`
+	DsmIp             string   `json:"dsm_ip"`
+	StagingTargetPath string   `json:"staging_target_path"`
+	TargetIqn         string   `json:"target_iqn,omitempty"`
+	Portals           []string `json:"portals,omitempty"`
+	MappingIndex      int      `json:"mapping_index"`
+	DevicePath        string   `json:"device_path,omitempty"` // the multipath device, or the by-path device of a single portal
+	Reclaim           bool     `json:"reclaim,omitempty"`     // fstrim the mounted thin volume periodically
+	LuksMapper        string   `json:"luks_mapper,omitempty"` // the name of the opened LUKS device in /dev/mapper
+	ShareName         string   `json:"share_name,omitempty"`
+	SmbUser           string   `json:"smb_user,omitempty"` // the local user granted read-write permission of the share by this stage
+
+	// ephemeral records are keyed by the volume handle and the target path of the inline volume
+	BackingVolumeId    string `json:"backing_volume_id,omitempty"`
+	BackingStagingPath string `json:"backing_staging_path,omitempty"`
+}
+
+type stagingStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newStagingStore(dir string) *stagingStore {
+	return &stagingStore{
+		dir: dir,
+	}
+}
+
+// a volume may be staged to more than one staging path, e.g. by two static PVs of the same volume,
+// so the records are keyed by both
+func (s *stagingStore) recordPath(volumeId string, stagingTargetPath string) string {
+	// volume id looks like "//<dsmIp>/iscsi/<lunName>", escape it to a flat file name
+	sum := sha256.Sum256([]byte(stagingTargetPath))
+	return filepath.Join(s.dir, url.PathEscape(volumeId)+"_"+hex.EncodeToString(sum[:8])+".json")
+}
+
+func (s *stagingStore) Save(record *stagingRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file then rename, so a crash never leaves a partial record
+	path := s.recordPath(record.VolumeId, record.StagingTargetPath)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *stagingStore) Get(volumeId string, stagingTargetPath string) (*stagingRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load(s.recordPath(volumeId, stagingTargetPath))
+}
+
+func (s *stagingStore) Delete(volumeId string, stagingTargetPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.recordPath(volumeId, stagingTargetPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Find returns the record of the volume staged to the path, or any record of the volume if the path is unknown,
+// e.g. NodeGetVolumeStats and NodeExpandVolume of the CSI versions without the staging path
+func (s *stagingStore) Find(volumeId string, stagingTargetPath string) (*stagingRecord, error) {
+	if stagingTargetPath != "" {
+		return s.Get(volumeId, stagingTargetPath)
+	}
+
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.VolumeId == volumeId {
+			return record, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// RemoveTempFiles removes the partial records left by a crash during Save
+func (s *stagingStore) RemoveTempFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json.tmp"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			log.Errorf("Failed to remove partial staging record [%s]: %v", file, err)
+		}
+	}
+}
+
+func (s *stagingStore) List() ([]*stagingRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []*stagingRecord
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		record, err := s.load(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			log.Errorf("Failed to load staging record [%s]: %v", file.Name(), err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *stagingStore) load(path string) (*stagingRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &stagingRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("Failed to parse staging record: %v", err)
+	}
+	return record, nil
+}
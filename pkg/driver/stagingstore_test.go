@@ -0,0 +1,130 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func Test_stagingStore_roundTrip(t *testing.T) {
+	s := newStagingStore(filepath.Join(t.TempDir(), "records"))
+
+	record := &stagingRecord{
+		VolumeId:          "//10.0.0.1/iscsi/k8s-csi-pvc-1",
+		Protocol:          "iscsi",
+		DsmIp:             "10.0.0.1",
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+		TargetIqn:         "iqn.2000-01.com.synology:dsm.k8s-csi-pvc-1",
+		Portals:           []string{"10.0.0.1:3260", "[fd00::1]:3260"},
+		MappingIndex:      3,
+		DevicePath:        "/dev/mapper/mpatha",
+		Reclaim:           true,
+	}
+	if err := s.Save(record); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	got, err := s.Get(record.VolumeId, record.StagingTargetPath)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, record) {
+		t.Errorf("Get() = %+v, want %+v", got, record)
+	}
+
+	if _, err := s.Get(record.VolumeId, "/other/globalmount"); !os.IsNotExist(err) {
+		t.Errorf("Get() of another staging path error = %v, want not exist", err)
+	}
+
+	got, err = s.Find(record.VolumeId, "")
+	if err != nil || !reflect.DeepEqual(got, record) {
+		t.Errorf("Find() without staging path = %+v, %v, want %+v", got, err, record)
+	}
+
+	if err := s.Delete(record.VolumeId, record.StagingTargetPath); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Delete(record.VolumeId, record.StagingTargetPath); err != nil {
+		t.Errorf("Delete() of a deleted record error = %v, want nil", err)
+	}
+	if _, err := s.Find(record.VolumeId, ""); !os.IsNotExist(err) {
+		t.Errorf("Find() of a deleted record error = %v, want not exist", err)
+	}
+}
+
+func Test_stagingStore_List(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "records")
+	s := newStagingStore(dir)
+
+	if records, err := s.List(); err != nil || len(records) != 0 {
+		t.Errorf("List() of a missing dir = %v, %v, want empty", records, err)
+	}
+
+	// the same volume staged to two paths, e.g. two static PVs
+	for _, path := range []string{"/staging/a", "/staging/b"} {
+		if err := s.Save(&stagingRecord{VolumeId: "vol-1", StagingTargetPath: path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ephemeral"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := s.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	paths := []string{}
+	for _, record := range records {
+		paths = append(paths, record.StagingTargetPath)
+	}
+	sort.Strings(paths)
+	if want := []string{"/staging/a", "/staging/b"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("List() staging paths = %v, want %v", paths, want)
+	}
+}
+
+func Test_stagingStore_RemoveTempFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "records")
+	s := newStagingStore(dir)
+
+	record := &stagingRecord{VolumeId: "vol-1", StagingTargetPath: "/staging/a"}
+	if err := s.Save(record); err != nil {
+		t.Fatal(err)
+	}
+	// a crash between the write and the rename of Save
+	tmpPath := s.recordPath("vol-2", "/staging/b") + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(`{"volume_id":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.RemoveTempFiles()
+
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temp file still exists, stat error = %v", err)
+	}
+	if _, err := s.Get(record.VolumeId, record.StagingTargetPath); err != nil {
+		t.Errorf("Get() of the saved record error = %v", err)
+	}
+}
+
+func Test_stagingStore_recordPath(t *testing.T) {
+	s := newStagingStore("/records")
+
+	a := s.recordPath("//10.0.0.1/iscsi/lun", "/staging/a")
+	b := s.recordPath("//10.0.0.1/iscsi/lun", "/staging/b")
+	if a == b {
+		t.Errorf("recordPath() of two staging paths = %v, want different paths", a)
+	}
+	if filepath.Dir(a) != "/records" {
+		t.Errorf("recordPath() = %v, want a file in /records", a)
+	}
+}
@@ -21,17 +21,27 @@ package driver
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/kubernetes/pkg/volume"
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
+	"k8s.io/utils/keymutex"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
 )
 
 func ParseEndpoint(ep string) (string, string, error) {
@@ -52,7 +62,7 @@ func NewControllerServer(d *Driver) *controllerServer {
 }
 
 func NewNodeServer(d *Driver) *nodeServer {
-	return &nodeServer{
+	ns := &nodeServer{
 		Driver:     d,
 		dsmService: d.DsmService,
 		Mounter: &mount.SafeFormatAndMount{
@@ -63,7 +73,16 @@ func NewNodeServer(d *Driver) *nodeServer {
 			chapUser:     "",
 			chapPassword: "",
 		},
+		stagingStore:   newStagingStore(StagingRecordDir),
+		ephemeralStore: newStagingStore(filepath.Join(StagingRecordDir, "ephemeral")),
+		volumeLocks:    keymutex.NewHashed(0),
+		targetLocks:    keymutex.NewHashed(0),
+		ephemeralLocks: keymutex.NewHashed(0),
 	}
+	ns.supervisor = newSessionSupervisor(ns, SessionCheckInterval)
+	ns.reclaimer = newReclaimScheduler(ns, ReclaimInterval, ReclaimJitter, ReclaimConcurrency)
+
+	return ns
 }
 
 func NewIdentityServer(d *Driver) *identityServer {
@@ -103,15 +122,72 @@ func RunControllerandNodePublishServer(endpoint string, d *Driver, cs csi.Contro
 	s.Start(endpoint, ids, cs, ns)
 }
 
+// logGRPC assigns a request ID to the request, which is logged with the DSM webapi calls of the request
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	log.Infof("GRPC call: %s", info.FullMethod)
-	log.Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	requestId := logger.NewRequestId()
+	fields := log.Fields{logger.RequestIdKey: requestId}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		fields[logger.VolumeIdKey] = r.GetVolumeId()
+	}
+	ctx = logger.WithFields(ctx, fields)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String(logger.RequestIdKey, requestId))
+
+	entry := logger.FromContext(ctx)
+	entry.Infof("GRPC call: %s", info.FullMethod)
+	entry.Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
 	resp, err := handler(ctx, req)
 	if err != nil {
-		log.Errorf("GRPC error: %v", err)
+		entry.Errorf("GRPC error: %v", err)
 	} else {
-		log.Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+		entry.Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
+
+// traceMount runs a mount or unmount command in a span of the request
+func traceMount(ctx context.Context, name string, targetPath string, run func() error) error {
+	_, span := tracing.StartChild(ctx, name, attribute.String("mount.target", targetPath))
+	err := run()
+	tracing.End(span, err)
+	return err
+}
+
+// metadataCarrier reads the trace context propagated by the sidecars in the gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
 	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func traceGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	// the liveness probes would flood the traces
+	if info.FullMethod == "/csi.v1.Identity/Probe" {
+		return handler(ctx, req)
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+
+	ctx, span := tracing.Start(ctx, info.FullMethod, attribute.String("rpc.system", "grpc"))
+	resp, err := handler(ctx, req)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	tracing.End(span, err)
 	return resp, err
 }
 
@@ -0,0 +1,129 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/kubernetes/pkg/volume/util/fs"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+const procMountInfoPath = "/proc/self/mountinfo"
+
+// statfs the mounted path and report both bytes and inodes usage
+func getVolumeUsage(volumePath string) ([]*csi.VolumeUsage, error) {
+	available, capacity, used, inodes, inodesFree, inodesUsed, err := fs.Info(volumePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*csi.VolumeUsage{
+		&csi.VolumeUsage{
+			Available: available,
+			Total:     capacity,
+			Used:      used,
+			Unit:      csi.VolumeUsage_BYTES,
+		},
+		&csi.VolumeUsage{
+			Available: inodesFree,
+			Total:     inodes,
+			Used:      inodesUsed,
+			Unit:      csi.VolumeUsage_INODES,
+		},
+	}, nil
+}
+
+func isBlockDevice(path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeDevice != 0
+}
+
+// the size of the device, which is read locally instead of the LUN size on DSM
+func getBlockDeviceSize(devicePath string) (int64, error) {
+	file, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return file.Seek(0, io.SeekEnd)
+}
+
+// the superblock options reflect the real filesystem state, e.g. ext4 errors=remount-ro,
+// while the per-mount options may be "ro" only because the volume was published read-only
+func isSuperblockReadOnly(volumePath string) (bool, error) {
+	infos, err := mount.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		return false, err
+	}
+
+	for _, info := range infos {
+		if info.MountPoint != volumePath {
+			continue
+		}
+		return utils.SliceContains(info.SuperOptions, "ro"), nil
+	}
+
+	return false, fmt.Errorf("Mount point [%s] is not found in %s", volumePath, procMountInfoPath)
+}
+
+func normalVolumeCondition() *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}
+}
+
+func abnormalVolumeCondition(msg string) *csi.VolumeCondition {
+	log.Warn(msg)
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  msg,
+	}
+}
+
+func (ns *nodeServer) getVolumeCondition(volumeId string, volumePath string, record *stagingRecord) *csi.VolumeCondition {
+	protocol, targetIqn := record.Protocol, record.TargetIqn
+
+	readOnly, err := isSuperblockReadOnly(volumePath)
+	if err != nil {
+		log.Errorf("Failed to check the mount options of [%s]: %v", volumePath, err)
+	} else if readOnly && protocol == utils.ProtocolIscsi {
+		return abnormalVolumeCondition(fmt.Sprintf("Volume[%s] filesystem on %s has been remounted read-only", volumeId, volumePath))
+	}
+
+	if protocol == utils.ProtocolIscsi && !hasSession(targetIqn, "") {
+		return abnormalVolumeCondition(fmt.Sprintf("Volume[%s] iSCSI session of target [%s] is gone", volumeId, targetIqn))
+	}
+
+	if state, ok := ns.supervisor.GetState(record.VolumeId, record.StagingTargetPath); ok && !state.Healthy() {
+		return abnormalVolumeCondition(fmt.Sprintf("Volume[%s] has %d/%d iSCSI sessions of target [%s]: %v",
+			volumeId, state.ActiveSessions, state.Portals, targetIqn, state.Err))
+	}
+
+	return normalVolumeCondition()
+}
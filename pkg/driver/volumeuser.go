@@ -0,0 +1,209 @@
+/*
+Copyright 2023 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// StorageClass parameter to create a DSM local user for each SMB volume
+const smbVolumeUserKey = "smb_volume_user"
+
+const (
+	volumeUserPasswordLen = 24
+	passwordLower         = "abcdefghijkmnopqrstuvwxyz"
+	passwordUpper         = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	passwordDigits        = "23456789"
+	passwordSymbols       = "-_.+=@%"
+)
+
+var (
+	kubeClient     kubernetes.Interface
+	kubeClientErr  error
+	kubeClientOnce sync.Once
+)
+
+// the secrets of the volume users are written by the controller running in the cluster
+func getKubeClient() (kubernetes.Interface, error) {
+	kubeClientOnce.Do(func() {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			kubeClientErr = fmt.Errorf("Failed to get in-cluster config: %v", err)
+			return
+		}
+		kubeClient, kubeClientErr = kubernetes.NewForConfig(config)
+	})
+	return kubeClient, kubeClientErr
+}
+
+func randomChar(chars string) (byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+	if err != nil {
+		return 0, err
+	}
+	return chars[n.Int64()], nil
+}
+
+// generatePassword returns a random password with all kinds of characters, which satisfies the strong password rules of DSM
+func generatePassword(length int) (string, error) {
+	all := passwordLower + passwordUpper + passwordDigits + passwordSymbols
+	password := make([]byte, length)
+	for i := range password {
+		chars := all
+		switch i {
+		case 0:
+			chars = passwordLower
+		case 1:
+			chars = passwordUpper
+		case 2:
+			chars = passwordDigits
+		case 3:
+			chars = passwordSymbols
+		}
+
+		c, err := randomChar(chars)
+		if err != nil {
+			return "", err
+		}
+		password[i] = c
+	}
+
+	// shuffle the leading characters of each kind
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j.Int64()] = password[j.Int64()], password[i]
+	}
+	return string(password), nil
+}
+
+// ensureVolumeUser creates the DSM local user of the share, or resets its password on retry since the old one is unknown
+func ensureVolumeUser(dsm *webapi.DSM, shareName string) (string, string, error) {
+	password, err := generatePassword(volumeUserPasswordLen)
+	if err != nil {
+		return "", "", err
+	}
+
+	users, err := dsm.UserList()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to list users: %v", err)
+	}
+
+	for _, user := range users {
+		if user.Name != shareName {
+			continue
+		}
+		if user.Description != models.VolumeUserDesc {
+			return "", "", fmt.Errorf("User [%s] already exists and is not created by csi driver", shareName)
+		}
+		if err := dsm.UserSetPassword(shareName, password); err != nil {
+			return "", "", fmt.Errorf("Failed to reset password of user [%s]: %v", shareName, err)
+		}
+		return shareName, password, nil
+	}
+
+	log.Infof("[%s] Create user [%s] for share [%s]", dsm.Ip, shareName, shareName)
+	if err := dsm.UserCreate(shareName, password, models.VolumeUserDesc); err != nil {
+		return "", "", fmt.Errorf("Failed to create user [%s]: %v", shareName, err)
+	}
+	return shareName, password, nil
+}
+
+// grantVolumeUser makes the volume user the only local user with permission of the share
+func grantVolumeUser(dsm *webapi.DSM, shareName string, userName string) error {
+	permissions, err := dsm.SharePermissionList(shareName, models.UserGroupTypeLocalUser)
+	if err != nil {
+		return err
+	}
+
+	updated := []*webapi.SharePermission{{Name: userName, IsWritable: true}}
+	for _, permission := range permissions {
+		if permission.Name == userName || permission.IsAdmin || !(permission.IsWritable || permission.IsReadonly) {
+			continue
+		}
+		updated = append(updated, &webapi.SharePermission{Name: permission.Name})
+	}
+
+	return dsm.SharePermissionSet(webapi.SharePermissionSetSpec{
+		Name:          shareName,
+		UserGroupType: models.UserGroupTypeLocalUser,
+		Permissions:   updated,
+	})
+}
+
+// writeVolumeUserSecret writes the credentials to the node-stage secret "<pv name>" in the namespace of the PVC,
+// which is owned by the PVC and garbage collected with it
+func writeVolumeUserSecret(ctx context.Context, name string, pvcName string, namespace string, userName string, password string) error {
+	client, err := getKubeClient()
+	if err != nil {
+		return err
+	}
+
+	pvc, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, pvcName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to get PVC %s/%s: %v", namespace, pvcName, err)
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": DriverName},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "PersistentVolumeClaim",
+				Name:       pvc.Name,
+				UID:        pvc.UID,
+			}},
+		},
+		Type: v1.SecretTypeOpaque,
+		StringData: map[string]string{
+			"username": userName,
+			"password": password,
+		},
+	}
+
+	_, err = client.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		existing, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if existing.Labels["app.kubernetes.io/managed-by"] != DriverName {
+			return fmt.Errorf("Secret %s/%s already exists and is not managed by %s", namespace, name, DriverName)
+		}
+		secret.ResourceVersion = existing.ResourceVersion
+		_, err = client.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
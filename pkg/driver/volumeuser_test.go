@@ -0,0 +1,121 @@
+// Copyright 2023 Synology Inc.
+
+package driver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+func Test_generatePassword(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		password, err := generatePassword(volumeUserPasswordLen)
+		if err != nil {
+			t.Fatalf("generatePassword() error = %v", err)
+		}
+		if len(password) != volumeUserPasswordLen {
+			t.Errorf("generatePassword() = %v, want %d characters", password, volumeUserPasswordLen)
+		}
+		for _, chars := range []string{passwordLower, passwordUpper, passwordDigits, passwordSymbols} {
+			if !strings.ContainsAny(password, chars) {
+				t.Errorf("generatePassword() = %v, want any of %v", password, chars)
+			}
+		}
+		if strings.Trim(password, passwordLower+passwordUpper+passwordDigits+passwordSymbols) != "" {
+			t.Errorf("generatePassword() = %v, has characters not allowed", password)
+		}
+	}
+}
+
+// newUserStubDsm returns a DSM listing the users, and the query and form of the user calls it receives
+func newUserStubDsm(t *testing.T, users []webapi.UserInfo) (*webapi.DSM, *[]url.Values) {
+	requests := []url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm() error = %v", err)
+		}
+		requests = append(requests, r.Form)
+
+		var data interface{}
+		if r.Form.Get("method") == "list" {
+			data = map[string]interface{}{"users": users}
+		}
+		body, _ := json.Marshal(map[string]interface{}{"success": true, "data": data})
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return &webapi.DSM{Ip: host, Port: portNum, Sid: "sid"}, &requests
+}
+
+func Test_ensureVolumeUser(t *testing.T) {
+	shareName := "k8s-csi-pvc-1"
+
+	tests := []struct {
+		name       string
+		users      []webapi.UserInfo
+		wantMethod string
+		wantErr    bool
+	}{
+		{
+			name:       "new user",
+			users:      []webapi.UserInfo{{Name: "admin"}},
+			wantMethod: "create",
+		},
+		{
+			name:       "user of a retry",
+			users:      []webapi.UserInfo{{Name: shareName, Description: models.VolumeUserDesc}},
+			wantMethod: "set",
+		},
+		{
+			name:    "user not created by the driver",
+			users:   []webapi.UserInfo{{Name: shareName, Description: "someone"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsm, requests := newUserStubDsm(t, tt.users)
+
+			userName, password, err := ensureVolumeUser(dsm, shareName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ensureVolumeUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(*requests) != 1 {
+					t.Errorf("ensureVolumeUser() sent %d requests, want only the user list", len(*requests))
+				}
+				return
+			}
+
+			if userName != shareName {
+				t.Errorf("ensureVolumeUser() user = %v, want %v", userName, shareName)
+			}
+			if len(password) != volumeUserPasswordLen {
+				t.Errorf("ensureVolumeUser() password = %v, want %d characters", password, volumeUserPasswordLen)
+			}
+
+			last := (*requests)[len(*requests)-1]
+			if got := last.Get("method"); got != tt.wantMethod {
+				t.Errorf("ensureVolumeUser() method = %v, want %v", got, tt.wantMethod)
+			}
+			if got := last.Get("name"); got != strconv.Quote(shareName) {
+				t.Errorf("ensureVolumeUser() name = %v, want %v", got, strconv.Quote(shareName))
+			}
+			if got := last.Get("password"); got != strconv.Quote(password) {
+				t.Errorf("ensureVolumeUser() sent password %v, want %v", got, strconv.Quote(password))
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ type ClientInfo struct {
 	Https           bool   `yaml:"https"`
 	Username        string `yaml:"username"`
 	Password        string `yaml:"password"`
+	IpFamily        string `yaml:"ipFamily"`
 }
 
 type SynoInfo struct {
@@ -5,6 +5,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -14,57 +15,80 @@ import (
 
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
 	"github.com/SynologyOpenSource/synology-csi/pkg/models"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 	"github.com/cenkalti/backoff/v4"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/utils/keymutex"
 )
 
 type DsmService struct {
 	dsms map[string]*webapi.DSM
+	ctx  context.Context // the request of the view returned by WithContext
+
+	// serializes picking a shared target with room and mapping the LUN to it on each DSM
+	sharedTargetLocks keymutex.KeyMutex
 }
 
 func NewDsmService() *DsmService {
 	return &DsmService{
-		dsms: make(map[string]*webapi.DSM),
+		dsms:              make(map[string]*webapi.DSM),
+		sharedTargetLocks: keymutex.NewHashed(0),
 	}
 }
 
 func (service *DsmService) AddDsm(client common.ClientInfo) error {
+	// IPv6 hosts may be written in brackets, the volume IDs use the bare address
+	host := strings.Trim(client.Host, "[]")
+
 	// TODO: use sn or other identifiers as key
-	if _, ok := service.dsms[client.Host]; ok {
-		log.Infof("Adding DSM [%s] already present.", client.Host)
+	if _, ok := service.dsms[host]; ok {
+		service.logEntry().Infof("Adding DSM [%s] already present.", host)
 		return nil
 	}
 
+	if err := utils.ValidateIpFamily(client.IpFamily); err != nil {
+		return fmt.Errorf("Invalid config of DSM: [%s]. err: %v", host, err)
+	}
+
+	logger.RegisterSecret(client.Password)
+
 	dsm := &webapi.DSM{
-		Ip:       client.Host,
+		Ip:       host,
 		Port:     client.Port,
 		Username: client.Username,
 		Password: client.Password,
 		Https:    client.Https,
+		IpFamily: client.IpFamily,
 	}
 	err := dsm.Login()
 	if err != nil {
 		return fmt.Errorf("Failed to login to DSM: [%s]. err: %v", dsm.Ip, err)
 	}
+	if sysInfo, err := dsm.DsmSystemInfoGet(); err != nil {
+		service.logEntry().Warnf("Failed to get serial of DSM [%s]: %v", dsm.Ip, err)
+	} else {
+		dsm.Serial = sysInfo.Serial
+	}
 	service.dsms[dsm.Ip] = dsm
-	log.Infof("Add DSM [%s].", dsm.Ip)
+	service.logEntry().Infof("Add DSM [%s].", dsm.Ip)
 	return nil
 }
 
 func (service *DsmService) RemoveAllDsms() {
 	for _, dsm := range service.dsms {
-		log.Infof("Going to logout DSM [%s]", dsm.Ip)
+		service.logEntry().Infof("Going to logout DSM [%s]", dsm.Ip)
 
 		for i := 0; i < 3; i++ {
 			err := dsm.Logout()
 			if err == nil {
 				break
 			}
-			log.Debugf("Retry to logout DSM [%s], retry: %d", dsm.Ip, i)
+			service.logEntry().Debugf("Retry to logout DSM [%s], retry: %d", dsm.Ip, i)
 		}
 	}
 	return
@@ -78,10 +102,31 @@ func (service *DsmService) GetDsm(ip string) (*webapi.DSM, error) {
 	return dsm, nil
 }
 
+// WithContext returns a view of the service whose webapi calls are traced and logged with the request of ctx
+func (service *DsmService) WithContext(ctx context.Context) interfaces.IDsmService {
+	dsms := make(map[string]*webapi.DSM, len(service.dsms))
+	for ip, dsm := range service.dsms {
+		dsms[ip] = dsm.WithContext(ctx)
+	}
+	return &DsmService{dsms: dsms, ctx: ctx, sharedTargetLocks: service.sharedTargetLocks}
+}
+
+func (service *DsmService) logEntry() *log.Entry {
+	return logger.FromContext(service.ctx)
+}
+
 func (service *DsmService) GetDsmsCount() int {
 	return len(service.dsms)
 }
 
+func (service *DsmService) ListDsms() []*webapi.DSM {
+	dsms := []*webapi.DSM{}
+	for _, dsm := range service.dsms {
+		dsms = append(dsms, dsm)
+	}
+	return dsms
+}
+
 func (service *DsmService) ListDsmVolumes(ip string) ([]webapi.VolInfo, error) {
 	var allVolInfos []webapi.VolInfo
 
@@ -150,50 +195,208 @@ func getLunTypeByInputParams(lunType string, isThin bool, locationFsType string)
 	return "", fmt.Errorf("Unknown volume fs type: %s", locationFsType)
 }
 
-func (service *DsmService) createMappingTarget(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, lunUuid string) (webapi.TargetInfo, error) {
-	dsmInfo, err := dsm.DsmInfoGet()
+func genTargetIqn(hostname string, name string) string {
+	iqn := models.IqnPrefix + fmt.Sprintf("%s.%s", hostname, name)
+	iqn = strings.ReplaceAll(iqn, "_", "-")
+	iqn = strings.ReplaceAll(iqn, "+", "p")
+
+	if len(iqn) > models.MaxIqnLen {
+		return iqn[:models.MaxIqnLen]
+	}
+	return iqn
+}
+
+// the names of the interfaces the target is bound to, nil if it listens on all interfaces
+func getTargetInterfaces(target webapi.TargetInfo) []string {
+	interfaces := []string{}
+	for _, portal := range target.NetworkPortals {
+		if portal.InterfaceName == webapi.NetworkPortalAllInterfaces {
+			return nil
+		}
+		if !utils.SliceContains(interfaces, portal.InterfaceName) {
+			interfaces = append(interfaces, portal.InterfaceName)
+		}
+	}
+	if len(interfaces) == 0 {
+		return nil
+	}
+	return interfaces
+}
 
+func isTargetBoundTo(target webapi.TargetInfo, interfaces []string) bool {
+	bound := getTargetInterfaces(target)
+	if len(bound) != len(interfaces) {
+		return false
+	}
+	for _, ifname := range interfaces {
+		if !utils.SliceContains(bound, ifname) {
+			return false
+		}
+	}
+	return true
+}
+
+// bind the target to the interfaces, on both controllers of a UC DSM
+func setTargetInterfaces(dsm *webapi.DSM, target webapi.TargetInfo, interfaces []string) error {
+	if len(interfaces) == 0 || isTargetBoundTo(target, interfaces) {
+		return nil
+	}
+
+	controllerIds := []int{0}
+	if dsm.IsUC() {
+		controllerIds = append(controllerIds, 1)
+	}
+
+	portals := []webapi.NetworkPortal{}
+	for _, controllerId := range controllerIds {
+		for _, ifname := range interfaces {
+			portals = append(portals, webapi.NetworkPortal{
+				ControllerId:  controllerId,
+				InterfaceName: ifname,
+			})
+		}
+	}
+
+	dsm.Logger().Debugf("TargetSetNetworkPortals target: %s, portals: %v", target.Name, portals)
+	return dsm.TargetSetNetworkPortals(strconv.Itoa(target.TargetId), portals)
+}
+
+// find the shared target which the lun is mapped to, or the first one of the same session mode bound to the same
+// interfaces which still has room for another lun
+func (service *DsmService) getSharedTarget(dsm *webapi.DSM, hostname string, lunUuid string, interfaces []string, multipleSession bool) (webapi.TargetInfo, error) {
+	targetInfos, err := dsm.TargetList()
 	if err != nil {
-		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s] info", dsm.Ip))
+		return webapi.TargetInfo{}, err
 	}
 
-	genTargetIqn := func() string {
-		iqn := models.IqnPrefix + fmt.Sprintf("%s.%s", dsmInfo.Hostname, spec.K8sVolumeName)
-		iqn = strings.ReplaceAll(iqn, "_", "-")
-		iqn = strings.ReplaceAll(iqn, "+", "p")
+	sessionMode := models.SharedTargetSingleSession
+	if multipleSession {
+		sessionMode = models.SharedTargetMultiSession
+	}
+	sharedPrefix := fmt.Sprintf("%s-%s-", models.TargetPrefix, models.SharedTargetInfix)
+	prefix := fmt.Sprintf("%s%s-", sharedPrefix, sessionMode)
+	usedNames := make(map[string]bool)
+	var available *webapi.TargetInfo
+	for i, target := range targetInfos {
+		if !strings.HasPrefix(target.Name, sharedPrefix) {
+			continue
+		}
+
+		for _, mapping := range target.MappedLuns {
+			if mapping.LunUuid == lunUuid {
+				return target, nil
+			}
+		}
+
+		if !strings.HasPrefix(target.Name, prefix) {
+			continue
+		}
+		usedNames[target.Name] = true
 
-		if len(iqn) > models.MaxIqnLen {
-			return iqn[:models.MaxIqnLen]
+		if available == nil && len(target.MappedLuns) < models.MaxLunsPerSharedTarget && isTargetBoundTo(target, interfaces) {
+			available = &targetInfos[i]
 		}
-		return iqn
 	}
+
+	if available != nil {
+		return *available, nil
+	}
+
+	name := ""
+	for i := 0; name == "" || usedNames[name]; i++ {
+		name = fmt.Sprintf("%s%d", prefix, i)
+	}
+
 	targetSpec := webapi.TargetCreateSpec{
-		Name: spec.TargetName,
-		Iqn:  genTargetIqn(),
+		Name: name,
+		Iqn:  genTargetIqn(hostname, name),
 	}
 
-	log.Debugf("TargetCreate spec: %v", targetSpec)
-	targetId, err := dsm.TargetCreate(targetSpec)
+	service.logEntry().Debugf("TargetCreate spec: %v", targetSpec)
+	if _, err := dsm.TargetCreate(targetSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
+		return webapi.TargetInfo{}, fmt.Errorf("Failed to create target with spec: %v, err: %v", targetSpec, err)
+	}
 
-	if err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
-		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to create target with spec: %v, err: %v", targetSpec, err))
+	targetInfo, err := dsm.TargetGet(name)
+	if err != nil {
+		return webapi.TargetInfo{}, err
+	}
+
+	// only a new target is set, the max sessions of an existing one would apply to all of its luns
+	if multipleSession {
+		if err := dsm.TargetSet(strconv.Itoa(targetInfo.TargetId), 0); err != nil {
+			return webapi.TargetInfo{}, fmt.Errorf("Failed to set target [%s] max session, err: %v", name, err)
+		}
 	}
 
-	targetInfo, err := dsm.TargetGet(targetSpec.Name)
+	if err := setTargetInterfaces(dsm, targetInfo, interfaces); err != nil {
+		return webapi.TargetInfo{}, fmt.Errorf("Failed to bind target [%s] to interfaces %v, err: %v", name, interfaces, err)
+	}
+	return targetInfo, nil
+}
+
+func (service *DsmService) createMappingTarget(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, lunUuid string) (webapi.TargetInfo, error) {
+	dsmInfo, err := dsm.DsmInfoGet()
+
 	if err != nil {
-		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get target with spec: %v, err: %v", targetSpec, err))
-	} else {
-		targetId = strconv.Itoa(targetInfo.TargetId)
+		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s] info", dsm.Ip))
 	}
 
-	if spec.MultipleSession == true {
-		if err := dsm.TargetSet(targetId, 0); err != nil {
-			return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to set target [%s] max session, err: %v", spec.TargetName, err))
+	var targetInfo webapi.TargetInfo
+	if spec.SharedTarget {
+		// the room of the target is checked before the lun is mapped
+		service.sharedTargetLocks.LockKey(dsm.Ip)
+		defer service.sharedTargetLocks.UnlockKey(dsm.Ip)
+
+		targetInfo, err = service.getSharedTarget(dsm, dsmInfo.Hostname, lunUuid, spec.TargetInterfaces, spec.MultipleSession)
+		if err != nil {
+			return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get shared target, err: %v", err))
+		}
+
+		// idempotency, the lun may have been mapped by the previous request
+		for _, mapping := range targetInfo.MappedLuns {
+			if mapping.LunUuid == lunUuid {
+				return targetInfo, nil
+			}
+		}
+	} else {
+		targetSpec := webapi.TargetCreateSpec{
+			Name: spec.TargetName,
+			Iqn:  genTargetIqn(dsmInfo.Hostname, spec.K8sVolumeName),
+		}
+
+		service.logEntry().Debugf("TargetCreate spec: %v", targetSpec)
+		_, err := dsm.TargetCreate(targetSpec)
+
+		if err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
+			return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to create target with spec: %v, err: %v", targetSpec, err))
+		}
+
+		targetInfo, err = dsm.TargetGet(targetSpec.Name)
+		if err != nil {
+			return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get target with spec: %v, err: %v", targetSpec, err))
+		}
+
+		if err := setTargetInterfaces(dsm, targetInfo, spec.TargetInterfaces); err != nil {
+			return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to bind target [%s] to interfaces %v, err: %v", targetInfo.Name, spec.TargetInterfaces, err))
+		}
+
+		if spec.MultipleSession == true {
+			if err := dsm.TargetSet(strconv.Itoa(targetInfo.TargetId), 0); err != nil {
+				return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to set target [%s] max session, err: %v", targetInfo.Name, err))
+			}
 		}
 	}
+	targetId := strconv.Itoa(targetInfo.TargetId)
 
 	if err := dsm.LunMapTarget([]string{targetId}, lunUuid); err != nil {
-		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to map target [%s] to lun [%s], err: %v", spec.TargetName, lunUuid, err))
+		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to map target [%s] to lun [%s], err: %v", targetInfo.Name, lunUuid, err))
+	}
+
+	// get the target again for the mapping index of the new lun
+	targetInfo, err = dsm.TargetGet(targetId)
+	if err != nil {
+		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get target [%s], err: %v", targetInfo.Name, err))
 	}
 
 	return targetInfo, nil
@@ -232,7 +435,7 @@ func (service *DsmService) createVolumeByDsm(dsm *webapi.DSM, spec *models.Creat
 		Description: spec.LunDescription,
 	}
 
-	log.Debugf("LunCreate spec: %v", lunSpec)
+	service.logEntry().Debugf("LunCreate spec: %v", lunSpec)
 	_, err = dsm.LunCreate(lunSpec)
 
 	if err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
@@ -256,7 +459,7 @@ func (service *DsmService) createVolumeByDsm(dsm *webapi.DSM, spec *models.Creat
 			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create and map target, err: %v", err))
 	}
 
-	log.Debugf("[%s] CreateVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
+	service.logEntry().Debugf("[%s] CreateVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
 
 	return DsmLunToK8sVolume(dsm.Ip, lunInfo, targetInfo), nil
 }
@@ -281,15 +484,15 @@ func waitCloneFinished(dsm *webapi.DSM, lunName string) error {
 	}
 
 	cloneNotify := func(err error, duration time.Duration) {
-		log.Infof("Lun is being locked for lun clone, waiting %3.2f seconds .....", float64(duration.Seconds()))
+		dsm.Logger().Infof("Lun is being locked for lun clone, waiting %3.2f seconds .....", float64(duration.Seconds()))
 	}
 
 	if err := backoff.RetryNotify(checkFinished, cloneBackoff, cloneNotify); err != nil {
-		log.Errorf("Could not finish clone after %3.2f seconds. err: %v", float64(cloneBackoff.MaxElapsedTime.Seconds()), err)
+		dsm.Logger().Errorf("Could not finish clone after %3.2f seconds. err: %v", float64(cloneBackoff.MaxElapsedTime.Seconds()), err)
 		return err
 	}
 
-	log.Debugf("Clone successfully. Lun: %v", lunName)
+	dsm.Logger().Debugf("Clone successfully. Lun: %v", lunName)
 	return nil
 }
 
@@ -326,7 +529,7 @@ func (service *DsmService) createVolumeBySnapshot(dsm *webapi.DSM, spec *models.
 			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create and map target, err: %v", err))
 	}
 
-	log.Debugf("[%s] createVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
+	service.logEntry().Debugf("[%s] createVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
 
 	return DsmLunToK8sVolume(dsm.Ip, lunInfo, targetInfo), nil
 }
@@ -368,7 +571,7 @@ func (service *DsmService) createVolumeByVolume(dsm *webapi.DSM, spec *models.Cr
 			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create and map target, err: %v", err))
 	}
 
-	log.Debugf("[%s] createVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
+	service.logEntry().Debugf("[%s] createVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
 
 	return DsmLunToK8sVolume(dsm.Ip, lunInfo, targetInfo), nil
 }
@@ -380,7 +583,7 @@ func DsmShareToK8sVolume(dsmIp string, info webapi.ShareInfo) *models.K8sVolumeR
 		SizeInBytes: utils.MBToBytes(info.QuotaValueInMB),
 		Location:    info.VolPath,
 		Name:        info.Name,
-		Source:      "//" + dsmIp + "/" + info.Name,
+		Source:      "//" + utils.BracketHost(dsmIp) + "/" + info.Name,
 		Protocol:    utils.ProtocolSmb,
 		Share:       info,
 	}
@@ -473,7 +676,7 @@ func (service *DsmService) CreateVolume(spec *models.CreateK8sVolumeSpec) (*mode
 		}
 
 		if err != nil {
-			log.Errorf("[%s] Failed to create Volume: %v", dsm.Ip, err)
+			service.logEntry().Errorf("[%s] Failed to create Volume: %v", dsm.Ip, err)
 			continue
 		}
 
@@ -486,7 +689,7 @@ func (service *DsmService) CreateVolume(spec *models.CreateK8sVolumeSpec) (*mode
 func (service *DsmService) DeleteVolume(volId string) error {
 	k8sVolume := service.GetVolume(volId)
 	if k8sVolume == nil {
-		log.Infof("Skip delete volume[%s] that is no exist", volId)
+		service.logEntry().Infof("Skip delete volume[%s] that is no exist", volId)
 		return nil
 	}
 
@@ -496,33 +699,78 @@ func (service *DsmService) DeleteVolume(volId string) error {
 	}
 
 	if k8sVolume.Protocol == utils.ProtocolSmb {
+		if err := deleteVolumeUser(dsm, k8sVolume.Share.Name); err != nil {
+			service.logEntry().Errorf("[%s] Failed to delete user of share(%s): %v", dsm.Ip, k8sVolume.Share.Name, err)
+			return err
+		}
+
 		if err := dsm.ShareDelete(k8sVolume.Share.Name); err != nil {
-			log.Errorf("[%s] Failed to delete Share(%s): %v", dsm.Ip, k8sVolume.Share.Name, err)
+			service.logEntry().Errorf("[%s] Failed to delete Share(%s): %v", dsm.Ip, k8sVolume.Share.Name, err)
 			return err
 		}
 	} else {
-		lun, target := k8sVolume.Lun, k8sVolume.Target
+		lun := k8sVolume.Lun
+
+		// a lun may be mapped to several targets, and a target may be shared by several luns
+		targetIds := []string{}
+		targetInfos, err := dsm.TargetList()
+		if err != nil {
+			service.logEntry().Errorf("[%s] Failed to list targets: %v", dsm.Ip, err)
+			targetIds = append(targetIds, strconv.Itoa(k8sVolume.Target.TargetId))
+		} else {
+			for _, target := range targetInfos {
+				for _, mapping := range target.MappedLuns {
+					if mapping.LunUuid == lun.Uuid {
+						targetIds = append(targetIds, strconv.Itoa(target.TargetId))
+						break
+					}
+				}
+			}
+		}
 
 		if err := dsm.LunDelete(lun.Uuid); err != nil {
 			if _, err := dsm.LunGet(lun.Uuid); err != nil && errors.Is(err, utils.NoSuchLunError("")) {
 				return nil
 			}
-			log.Errorf("[%s] Failed to delete LUN(%s): %v", dsm.Ip, lun.Uuid, err)
+			service.logEntry().Errorf("[%s] Failed to delete LUN(%s): %v", dsm.Ip, lun.Uuid, err)
 			return err
 		}
 
-		if len(target.MappedLuns) != 1 {
-			log.Infof("Skip deletes target[%s] that was mapped with lun. DSM[%s]", target.Name, dsm.Ip)
-			return nil
+		for _, targetId := range targetIds {
+			if err := deleteTargetIfUnmapped(dsm, targetId); err != nil {
+				return err
+			}
 		}
+	}
 
-		if err := dsm.TargetDelete(strconv.Itoa(target.TargetId)); err != nil {
-			if _, err := dsm.TargetGet(strconv.Itoa(target.TargetId)); err != nil {
-				return nil
-			}
-			log.Errorf("[%s] Failed to delete target(%d): %v", dsm.Ip, target.TargetId, err)
-			return err
+	return nil
+}
+
+// delete the target when no lun is mapped to it anymore
+func deleteTargetIfUnmapped(dsm *webapi.DSM, targetId string) error {
+	// get the target again, other luns of a shared target may be deleted concurrently
+	target, err := dsm.TargetGet(targetId)
+	if err != nil {
+		dsm.Logger().Infof("Skip deletes target[%s] that is no exist. DSM[%s]", targetId, dsm.Ip)
+		return nil
+	}
+
+	if len(target.MappedLuns) != 0 {
+		dsm.Logger().Infof("Skip deletes target[%s] that was mapped with %d luns. DSM[%s]", target.Name, len(target.MappedLuns), dsm.Ip)
+		return nil
+	}
+
+	if !strings.HasPrefix(target.Name, models.TargetPrefix) {
+		dsm.Logger().Infof("Skip deletes target[%s] that is not created by CSI. DSM[%s]", target.Name, dsm.Ip)
+		return nil
+	}
+
+	if err := dsm.TargetDelete(targetId); err != nil {
+		if _, err := dsm.TargetGet(targetId); err != nil {
+			return nil
 		}
+		dsm.Logger().Errorf("[%s] Failed to delete target(%s): %v", dsm.Ip, targetId, err)
+		return err
 	}
 
 	return nil
@@ -536,23 +784,30 @@ func (service *DsmService) listISCSIVolumes(dsmIp string) (infos []*models.K8sVo
 
 		targetInfos, err := dsm.TargetList()
 		if err != nil {
-			log.Errorf("[%s] Failed to list targets: %v", dsm.Ip, err)
+			service.logEntry().Errorf("[%s] Failed to list targets: %v", dsm.Ip, err)
 			continue
 		}
 
+		listedLuns := make(map[string]bool)
 		for _, target := range targetInfos {
 			// TODO: use target.ConnectedSessions to filter targets
 			for _, mapping := range target.MappedLuns {
+				// a LUN mapped to several targets is listed once, with the first target found
+				if listedLuns[mapping.LunUuid] {
+					continue
+				}
+
 				lun, err := dsm.LunGet(mapping.LunUuid)
 				if err != nil {
-					log.Errorf("[%s] Failed to get LUN(%s): %v", dsm.Ip, mapping.LunUuid, err)
+					service.logEntry().Errorf("[%s] Failed to get LUN(%s): %v", dsm.Ip, mapping.LunUuid, err)
+					continue
 				}
 
 				if !strings.HasPrefix(lun.Name, models.LunPrefix) {
 					continue
 				}
 
-				// FIXME: filter same LUN mapping to two target
+				listedLuns[mapping.LunUuid] = true
 				infos = append(infos, DsmLunToK8sVolume(dsm.Ip, lun, target))
 			}
 		}
@@ -620,7 +875,7 @@ func (service *DsmService) ExpandVolume(volId string, newSize int64) (*models.K8
 	if k8sVolume.Protocol == utils.ProtocolSmb {
 		newSizeInMB := utils.BytesToMBCeil(newSize) // round up to MB
 		if err := dsm.SetShareQuota(k8sVolume.Share, newSizeInMB); err != nil {
-			log.Errorf("[%s] Failed to set quota [%d (MB)] to Share [%s]: %v",
+			service.logEntry().Errorf("[%s] Failed to set quota [%d (MB)] to Share [%s]: %v",
 				dsm.Ip, newSizeInMB, k8sVolume.Share.Name, err)
 			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to expand volume[%s]. err: %v", volId, err))
 		}
@@ -725,7 +980,7 @@ func (service *DsmService) DeleteSnapshot(snapshotUuid string) error {
 				return nil
 			}
 
-			log.Errorf("Failed to delete Share snapshot [%s]. err: %v", snapshotUuid, err)
+			service.logEntry().Errorf("Failed to delete Share snapshot [%s]. err: %v", snapshotUuid, err)
 			return err
 		}
 	} else if snapshot.Protocol == utils.ProtocolIscsi {
@@ -734,7 +989,7 @@ func (service *DsmService) DeleteSnapshot(snapshotUuid string) error {
 				return nil
 			}
 
-			log.Errorf("Failed to delete LUN snapshot [%s]. err: %v", snapshotUuid, err)
+			service.logEntry().Errorf("Failed to delete LUN snapshot [%s]. err: %v", snapshotUuid, err)
 			return err
 		}
 	}
@@ -748,7 +1003,7 @@ func (service *DsmService) listISCSISnapshotsByDsm(dsm *webapi.DSM) (infos []*mo
 		lunInfo := volume.Lun
 		lunSnaps, err := dsm.SnapshotList(lunInfo.Uuid)
 		if err != nil {
-			log.Errorf("[%s] Failed to list LUN[%s] snapshots: %v", dsm.Ip, lunInfo.Uuid, err)
+			service.logEntry().Errorf("[%s] Failed to list LUN[%s] snapshots: %v", dsm.Ip, lunInfo.Uuid, err)
 			continue
 		}
 
@@ -780,14 +1035,14 @@ func (service *DsmService) ListSnapshots(volId string) []*models.K8sSnapshotResp
 
 	dsm, err := service.GetDsm(k8sVolume.DsmIp)
 	if err != nil {
-		log.Errorf("Failed to get DSM[%s]", k8sVolume.DsmIp)
+		service.logEntry().Errorf("Failed to get DSM[%s]", k8sVolume.DsmIp)
 		return nil
 	}
 
 	if k8sVolume.Protocol == utils.ProtocolIscsi {
 		infos, err := dsm.SnapshotList(volId)
 		if err != nil {
-			log.Errorf("Failed to SnapshotList[%s]", volId)
+			service.logEntry().Errorf("Failed to SnapshotList[%s]", volId)
 			return nil
 		}
 		for _, info := range infos {
@@ -796,7 +1051,7 @@ func (service *DsmService) ListSnapshots(volId string) []*models.K8sSnapshotResp
 	} else {
 		infos, err := dsm.ShareSnapshotList(k8sVolume.Share.Name)
 		if err != nil {
-			log.Errorf("Failed to ShareSnapshotList[%s]", k8sVolume.Share.Name)
+			service.logEntry().Errorf("Failed to ShareSnapshotList[%s]", k8sVolume.Share.Name)
 			return nil
 		}
 		for _, info := range infos {
@@ -0,0 +1,182 @@
+// Copyright 2023 Synology Inc.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// newTargetStubDsm returns a DSM serving the iSCSI targets, and the names of the targets created by the calls
+func newTargetStubDsm(t *testing.T, targets []webapi.TargetInfo) (*webapi.DSM, *[]string) {
+	created := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var data interface{}
+		switch query.Get("method") {
+		case "list":
+			data = map[string]interface{}{"targets": targets}
+		case "create":
+			name := query.Get("name")
+			created = append(created, name)
+			targets = append(targets, webapi.TargetInfo{Name: name, TargetId: 100 + len(created)})
+			data = map[string]interface{}{"target_id": 100 + len(created)}
+		case "get":
+			name, _ := strconv.Unquote(query.Get("target_id"))
+			for _, target := range targets {
+				if target.Name == name {
+					data = map[string]interface{}{"target": target}
+				}
+			}
+		}
+
+		body, _ := json.Marshal(map[string]interface{}{"success": true, "data": data})
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return &webapi.DSM{Ip: host, Port: portNum, Sid: "sid"}, &created
+}
+
+func mappedLuns(count int, prefix string) []webapi.MappedLun {
+	luns := []webapi.MappedLun{}
+	for i := 0; i < count; i++ {
+		luns = append(luns, webapi.MappedLun{LunUuid: fmt.Sprintf("%s-%d", prefix, i), MappingIndex: i})
+	}
+	return luns
+}
+
+func TestDsmService_getSharedTarget(t *testing.T) {
+	tests := []struct {
+		name            string
+		targets         []webapi.TargetInfo
+		lunUuid         string
+		multipleSession bool
+		want            string
+		wantCreated     []string
+	}{
+		{
+			name:        "first shared target",
+			lunUuid:     "lun-new",
+			want:        "csi-shared-single-0",
+			wantCreated: []string{"csi-shared-single-0"},
+		},
+		{
+			name:            "first shared target of multiple sessions",
+			lunUuid:         "lun-new",
+			multipleSession: true,
+			want:            "csi-shared-multi-0",
+			wantCreated:     []string{"csi-shared-multi-0"},
+		},
+		{
+			name: "target with room",
+			targets: []webapi.TargetInfo{
+				{Name: "csi-shared-single-0", TargetId: 1, MappedLuns: mappedLuns(models.MaxLunsPerSharedTarget-1, "a")},
+			},
+			lunUuid:     "lun-new",
+			want:        "csi-shared-single-0",
+			wantCreated: []string{},
+		},
+		{
+			name: "full target",
+			targets: []webapi.TargetInfo{
+				{Name: "csi-shared-single-0", TargetId: 1, MappedLuns: mappedLuns(models.MaxLunsPerSharedTarget, "a")},
+			},
+			lunUuid:     "lun-new",
+			want:        "csi-shared-single-1",
+			wantCreated: []string{"csi-shared-single-1"},
+		},
+		{
+			name: "free name after a deleted target",
+			targets: []webapi.TargetInfo{
+				{Name: "csi-shared-single-1", TargetId: 2, MappedLuns: mappedLuns(models.MaxLunsPerSharedTarget, "a")},
+			},
+			lunUuid:     "lun-new",
+			want:        "csi-shared-single-0",
+			wantCreated: []string{"csi-shared-single-0"},
+		},
+		{
+			name: "target of another session mode",
+			targets: []webapi.TargetInfo{
+				{Name: "csi-shared-multi-0", TargetId: 1, MappedLuns: mappedLuns(1, "a")},
+			},
+			lunUuid:     "lun-new",
+			want:        "csi-shared-single-0",
+			wantCreated: []string{"csi-shared-single-0"},
+		},
+		{
+			name: "lun already mapped to a full target",
+			targets: []webapi.TargetInfo{
+				{Name: "csi-shared-single-0", TargetId: 1, MappedLuns: mappedLuns(models.MaxLunsPerSharedTarget, "a")},
+			},
+			lunUuid:     "a-5",
+			want:        "csi-shared-single-0",
+			wantCreated: []string{},
+		},
+		{
+			name: "dedicated targets are ignored",
+			targets: []webapi.TargetInfo{
+				{Name: "csi-k8s-pvc-1", TargetId: 1},
+			},
+			lunUuid:     "lun-new",
+			want:        "csi-shared-single-0",
+			wantCreated: []string{"csi-shared-single-0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsm, created := newTargetStubDsm(t, tt.targets)
+			service := &DsmService{}
+
+			got, err := service.getSharedTarget(dsm, "dsm", tt.lunUuid, nil, tt.multipleSession)
+			if err != nil {
+				t.Fatalf("getSharedTarget() error = %v", err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("getSharedTarget() = %v, want %v", got.Name, tt.want)
+			}
+			if fmt.Sprint(*created) != fmt.Sprint(tt.wantCreated) {
+				t.Errorf("getSharedTarget() created %v, want %v", *created, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func Test_genTargetIqn(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		target   string
+		want     string
+	}{
+		{
+			name:     "shared target",
+			hostname: "dsm",
+			target:   "csi-shared-single-0",
+			want:     "iqn.2000-01.com.synology:dsm.csi-shared-single-0",
+		},
+		{
+			name:     "invalid characters",
+			hostname: "my_dsm",
+			target:   "csi-a+b",
+			want:     "iqn.2000-01.com.synology:my-dsm.csi-apb",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := genTargetIqn(tt.hostname, tt.target); got != tt.want {
+				t.Errorf("genTargetIqn() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
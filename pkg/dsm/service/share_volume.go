@@ -28,12 +28,61 @@ func GMTToUnixSecond(timeStr string) int64 {
 	return t.Unix()
 }
 
+// the clone of a share is encrypted if and only if the source is, and the source must be unlocked to be cloned
+func checkCloneEncryption(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcShareInfo webapi.ShareInfo) error {
+	if srcShareInfo.Encryption == webapi.ShareEncryptionNone {
+		if spec.Encrypted {
+			return status.Errorf(codes.InvalidArgument, fmt.Sprintf("Can't create an encrypted share from the plain share [%s]", srcShareInfo.Name))
+		}
+		return nil
+	}
+
+	return unlockShare(dsm, &srcShareInfo, spec.EncryptionKey)
+}
+
+func unlockShare(dsm *webapi.DSM, shareInfo *webapi.ShareInfo, key string) error {
+	if shareInfo.Encryption != webapi.ShareEncryptionUnmounted {
+		return nil
+	}
+
+	if key == "" {
+		return status.Errorf(codes.InvalidArgument, fmt.Sprintf("Share [%s] is encrypted, the key is required in the provisioner secret", shareInfo.Name))
+	}
+
+	if err := dsm.ShareDecrypt(shareInfo.Name, key); err != nil {
+		return status.Errorf(codes.Internal, fmt.Sprintf("Failed to unlock share [%s], err: %v", shareInfo.Name, err))
+	}
+	shareInfo.Encryption = webapi.ShareEncryptionMounted
+
+	return nil
+}
+
+// deleteVolumeUser deletes the local user created for the share with smb_volume_user
+func deleteVolumeUser(dsm *webapi.DSM, shareName string) error {
+	users, err := dsm.UserList()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if user.Name == shareName && user.Description == models.VolumeUserDesc {
+			dsm.Logger().Infof("[%s] Delete user [%s] of share [%s]", dsm.Ip, user.Name, shareName)
+			return dsm.UserDelete(user.Name)
+		}
+	}
+	return nil
+}
+
 func (service *DsmService) createSMBVolumeBySnapshot(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcSnapshot *models.K8sSnapshotRespSpec) (*models.K8sVolumeRespSpec, error) {
 	srcShareInfo, err := dsm.ShareGet(srcSnapshot.ParentName)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get share: %s, err: %v", srcSnapshot.ParentName, err))
 	}
 
+	if err := checkCloneEncryption(dsm, spec, srcShareInfo); err != nil {
+		return nil, err
+	}
+
 	shareCloneSpec := webapi.ShareCloneSpec{
 		Name:     spec.ShareName,
 		Snapshot: srcSnapshot.Time,
@@ -58,12 +107,17 @@ func (service *DsmService) createSMBVolumeBySnapshot(dsm *webapi.DSM, spec *mode
 			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed Share with name: [%s], err: %v", spec.ShareName, err))
 	}
 
+	// the clone of an encrypted share is encrypted with the same key
+	if err := unlockShare(dsm, &shareInfo, spec.EncryptionKey); err != nil {
+		return nil, err
+	}
+
 	newSizeInMB := utils.BytesToMBCeil(spec.Size)
 	if shareInfo.QuotaValueInMB == 0 {
 		// known issue for some DS, manually set quota to the new share
 		if err := dsm.SetShareQuota(shareInfo, newSizeInMB); err != nil {
 			msg := fmt.Sprintf("Failed to set quota [%d] to Share [%s], err: %v", newSizeInMB, shareInfo.Name, err)
-			log.Error(msg)
+			service.logEntry().Error(msg)
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 
@@ -76,7 +130,7 @@ func (service *DsmService) createSMBVolumeBySnapshot(dsm *webapi.DSM, spec *mode
 			status.Errorf(codes.OutOfRange, "Requested share quotaMB [%d] is not equal to snapshot restore quotaMB [%d]", newSizeInMB, shareInfo.QuotaValueInMB)
 	}
 
-	log.Debugf("[%s] createSMBVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
+	service.logEntry().Debugf("[%s] createSMBVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
 
 	return DsmShareToK8sVolume(dsm.Ip, shareInfo), nil
 }
@@ -88,6 +142,10 @@ func (service *DsmService) createSMBVolumeByVolume(dsm *webapi.DSM, spec *models
 			status.Errorf(codes.OutOfRange, "Requested share quotaMB [%d] is not equal to src share quotaMB [%d]", newSizeInMB, srcShareInfo.QuotaValueInMB)
 	}
 
+	if err := checkCloneEncryption(dsm, spec, srcShareInfo); err != nil {
+		return nil, err
+	}
+
 	shareCloneSpec := webapi.ShareCloneSpec{
 		Name:     spec.ShareName,
 		Snapshot: "",
@@ -112,18 +170,22 @@ func (service *DsmService) createSMBVolumeByVolume(dsm *webapi.DSM, spec *models
 			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed Share with name: [%s], err: %v", spec.ShareName, err))
 	}
 
+	if err := unlockShare(dsm, &shareInfo, spec.EncryptionKey); err != nil {
+		return nil, err
+	}
+
 	if shareInfo.QuotaValueInMB == 0 {
 		// known issue for some DS, manually set quota to the new share
 		if err := dsm.SetShareQuota(shareInfo, newSizeInMB); err != nil {
 			msg := fmt.Sprintf("Failed to set quota [%d] to Share [%s], err: %v", newSizeInMB, shareInfo.Name, err)
-			log.Error(msg)
+			service.logEntry().Error(msg)
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 
 		shareInfo.QuotaValueInMB = newSizeInMB
 	}
 
-	log.Debugf("[%s] createSMBVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
+	service.logEntry().Debugf("[%s] createSMBVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
 
 	return DsmShareToK8sVolume(dsm.Ip, shareInfo), nil
 }
@@ -148,6 +210,10 @@ func (service *DsmService) createSMBVolumeByDsm(dsm *webapi.DSM, spec *models.Cr
 
 	// 3. Create Share
 	sizeInMB := utils.BytesToMBCeil(spec.Size)
+	encryption := webapi.ShareEncryptionNone
+	if spec.Encrypted {
+		encryption = webapi.ShareEncryptionMounted
+	}
 	shareSpec := webapi.ShareCreateSpec{
 		Name: spec.ShareName,
 		ShareInfo: webapi.ShareInfo{
@@ -157,12 +223,15 @@ func (service *DsmService) createSMBVolumeByDsm(dsm *webapi.DSM, spec *models.Cr
 			EnableShareCow:      false,
 			EnableRecycleBin:    spec.RecycleBin,
 			RecycleBinAdminOnly: spec.RecycleBin,
-			Encryption:          0,
+			Encryption:          encryption,
+			EncPasswd:           spec.EncryptionKey,
 			QuotaForCreate:      &sizeInMB,
 		},
 	}
 
-	log.Debugf("ShareCreate spec: %v", shareSpec)
+	logSpec := shareSpec
+	logSpec.ShareInfo.EncPasswd = ""
+	service.logEntry().Debugf("ShareCreate spec: %v", logSpec)
 	err = dsm.ShareCreate(shareSpec)
 	if err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to create share, err: %v", err))
@@ -174,7 +243,12 @@ func (service *DsmService) createSMBVolumeByDsm(dsm *webapi.DSM, spec *models.Cr
 			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed Share with name: %s, err: %v", spec.ShareName, err))
 	}
 
-	log.Debugf("[%s] createSMBVolumeByDsm Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
+	// an existing share of the same name may have been locked by a DSM reboot
+	if err := unlockShare(dsm, &shareInfo, spec.EncryptionKey); err != nil {
+		return nil, err
+	}
+
+	service.logEntry().Debugf("[%s] createSMBVolumeByDsm Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
 
 	return DsmShareToK8sVolume(dsm.Ip, shareInfo), nil
 }
@@ -191,7 +265,7 @@ func (service *DsmService) listSMBVolumes(dsmIp string) (infos []*models.K8sVolu
 
 		shares, err := dsm.ShareList()
 		if err != nil {
-			log.Errorf("[%s] Failed to list shares: %v", dsm.Ip, err)
+			service.logEntry().Errorf("[%s] Failed to list shares: %v", dsm.Ip, err)
 			continue
 		}
 
@@ -212,7 +286,7 @@ func (service *DsmService) listSMBSnapshotsByDsm(dsm *webapi.DSM) (infos []*mode
 		shareInfo := volume.Share
 		shareSnaps, err := dsm.ShareSnapshotList(shareInfo.Name)
 		if err != nil {
-			log.Errorf("[%s] Failed to list share snapshots: %v", dsm.Ip, err)
+			service.logEntry().Errorf("[%s] Failed to list share snapshots: %v", dsm.Ip, err)
 			continue
 		}
 		for _, info := range shareSnaps {
@@ -0,0 +1,108 @@
+// Copyright 2023 Synology Inc.
+
+package webapi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/metrics"
+)
+
+// The circuit breaker of each DSM opens after BreakerThreshold webapi calls in a row failed without a DSM error code,
+// e.g. the connection timed out. The calls then fail at once until BreakerCooldown has passed, when a single trial
+// call is let through to close it again. BreakerThreshold 0 disables the circuit breakers.
+var (
+	BreakerThreshold = 5
+	BreakerCooldown  = 30 * time.Second
+)
+
+type breakerState int
+
+// the values of the circuit breaker state metric
+const (
+	breakerClosed   breakerState = 0
+	breakerHalfOpen breakerState = 1
+	breakerOpen     breakerState = 2
+)
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	dsmIp    string
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+func getBreaker(dsmIp string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	if b, ok := breakers[dsmIp]; ok {
+		return b
+	}
+	b := &circuitBreaker{dsmIp: dsmIp}
+	breakers[dsmIp] = b
+	metrics.DsmCircuitBreakerState.WithLabelValues(dsmIp).Set(float64(breakerClosed))
+
+	return b
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	metrics.DsmCircuitBreakerState.WithLabelValues(b.dsmIp).Set(float64(state))
+}
+
+// allow returns an error if the call must not be sent to the DSM
+func (b *circuitBreaker) allow() error {
+	if BreakerThreshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < BreakerCooldown {
+			return fmt.Errorf("DSM [%s] is unreachable, the circuit breaker is open", b.dsmIp)
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		return fmt.Errorf("DSM [%s] is unreachable, waiting for the trial call of the circuit breaker", b.dsmIp)
+	}
+	return nil
+}
+
+// done records the result of an allowed call, failed if the DSM could not be reached
+func (b *circuitBreaker) done(failed bool) {
+	if BreakerThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= BreakerThreshold {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			b.setState(breakerOpen)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Synology Inc.
+
+package webapi
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	defer func(threshold int, cooldown time.Duration) {
+		BreakerThreshold, BreakerCooldown = threshold, cooldown
+	}(BreakerThreshold, BreakerCooldown)
+	BreakerThreshold = 2
+	BreakerCooldown = time.Hour
+
+	tests := []struct {
+		name      string
+		failed    []bool
+		cooled    bool
+		wantState breakerState
+		wantAllow bool
+	}{
+		{
+			name:      "closed below the threshold",
+			failed:    []bool{true},
+			wantState: breakerClosed,
+			wantAllow: true,
+		},
+		{
+			name:      "success resets the failures",
+			failed:    []bool{true, false, true},
+			wantState: breakerClosed,
+			wantAllow: true,
+		},
+		{
+			name:      "open at the threshold",
+			failed:    []bool{true, true},
+			wantState: breakerOpen,
+			wantAllow: false,
+		},
+		{
+			name:      "half-open after the cooldown",
+			failed:    []bool{true, true},
+			cooled:    true,
+			wantState: breakerHalfOpen,
+			wantAllow: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreaker{dsmIp: "192.0.2.1"}
+			for _, failed := range tt.failed {
+				b.done(failed)
+			}
+			if tt.cooled {
+				b.openedAt = time.Now().Add(-BreakerCooldown)
+			}
+			if err := b.allow(); (err == nil) != tt.wantAllow {
+				t.Errorf("allow() error = %v, wantAllow %v", err, tt.wantAllow)
+			}
+			if b.state != tt.wantState {
+				t.Errorf("state = %v, want %v", b.state, tt.wantState)
+			}
+		})
+	}
+}
+
+func Test_circuitBreaker_trial(t *testing.T) {
+	defer func(threshold int, cooldown time.Duration) {
+		BreakerThreshold, BreakerCooldown = threshold, cooldown
+	}(BreakerThreshold, BreakerCooldown)
+	BreakerThreshold = 1
+	BreakerCooldown = 0
+
+	b := &circuitBreaker{dsmIp: "192.0.2.2"}
+	b.done(true)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow() of the trial call error = %v", err)
+	}
+	if err := b.allow(); err == nil {
+		t.Errorf("allow() during the trial call error = nil, want an error")
+	}
+
+	b.done(true)
+	if b.state != breakerOpen {
+		t.Errorf("state after a failed trial = %v, want %v", b.state, breakerOpen)
+	}
+
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow() of the second trial call error = %v", err)
+	}
+	b.done(false)
+	if b.state != breakerClosed {
+		t.Errorf("state after a successful trial = %v, want %v", b.state, breakerClosed)
+	}
+}
+
+func Test_circuitBreaker_disabled(t *testing.T) {
+	defer func(threshold int) { BreakerThreshold = threshold }(BreakerThreshold)
+	BreakerThreshold = 0
+
+	b := &circuitBreaker{dsmIp: "192.0.2.3"}
+	for i := 0; i < 10; i++ {
+		b.done(true)
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("allow() error = %v, want nil", err)
+	}
+}
@@ -5,15 +5,26 @@
 package webapi
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/SynologyOpenSource/synology-csi/pkg/audit"
 	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+	"github.com/SynologyOpenSource/synology-csi/pkg/metrics"
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 )
 
 type DSM struct {
@@ -24,6 +35,11 @@ type DSM struct {
 	Sid      string
 	Https    bool
 	Controller string //new
+	IpFamily string // preferred address family when Ip is a domain, "ipv4" or "ipv6"
+	Serial   string // recorded in the audit log, empty if unknown
+
+	ctx    context.Context // the request traced by the webapi calls, see WithContext
+	parent *DSM
 }
 
 type errData struct {
@@ -42,37 +58,131 @@ type Response struct {
 	Data       interface{}
 }
 
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[string]*http.Transport)
+)
+
+// dial the resolved addresses of the host in order, so the preferred address family is tried first
+func newDialContext(ipFamily string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := utils.LookupIP(host, ipFamily)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// the transports are shared by the DSMs with the same settings, so the idle connections are reused
+func getTransport(https bool, ipFamily string) *http.Transport {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	key := fmt.Sprintf("%t/%s", https, ipFamily)
+	if tr, ok := transports[key]; ok {
+		return tr
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = newDialContext(ipFamily)
+	if https {
+		// TODO: input CA certificate and fill in tls config
+		// Skip Verify when https
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	transports[key] = tr
+
+	return tr
+}
+
+// WithContext returns a copy of the DSM whose webapi calls are traced as the children of the span in ctx
+func (dsm *DSM) WithContext(ctx context.Context) *DSM {
+	copied := *dsm
+	copied.ctx = ctx
+	copied.parent = dsm
+	if dsm.parent != nil {
+		copied.parent = dsm.parent
+	}
+	return &copied
+}
+
+// Logger returns the log entry of the webapi calls, with the fields of the request in dsm.ctx
+func (dsm *DSM) Logger() *log.Entry {
+	return logger.FromContext(dsm.ctx).WithField(logger.DsmKey, dsm.Ip)
+}
+
 func (dsm *DSM) sendRequest(data string, apiTemplate interface{}, params url.Values, cgiPath string) (Response, error) {
-	resp, err := dsm.sendRequestWithoutConnectionCheck(data, apiTemplate, params, cgiPath)
+	resp, err := dsm.sendRequestWithMetrics(data, apiTemplate, params, cgiPath)
 	if err != nil && (resp.ErrorCode == 105 || resp.ErrorCode == 119) { // 105: WEBAPI_ERR_NO_PERMISSION, 119: WEBAPI_ERR_SID_NOT_FOUND
 		// Re-login
-		if err := dsm.Login(); err != nil {
+		err := dsm.Login()
+		metrics.ObserveRelogin(dsm.Ip, err)
+		if err != nil {
 			return Response{}, fmt.Errorf("Failed to re-login to DSM: [%s]. err: %v", dsm.Ip, err)
 		}
-		log.Info("Re-login succeeded.")
-		return dsm.sendRequestWithoutConnectionCheck(data, apiTemplate, params, cgiPath);
+		dsm.Logger().Info("Re-login succeeded.")
+		return dsm.sendRequestWithMetrics(data, apiTemplate, params, cgiPath);
+	}
+
+	return resp, err
+}
+
+func (dsm *DSM) sendRequestWithMetrics(data string, apiTemplate interface{}, params url.Values, cgiPath string) (Response, error) {
+	_, span := tracing.StartChild(dsm.ctx, "webapi "+params.Get("api")+"."+params.Get("method"),
+		attribute.String("dsm", dsm.Ip),
+		attribute.String("webapi.api", params.Get("api")),
+		attribute.String("webapi.method", params.Get("method")))
+
+	start := time.Now()
+	var resp Response
+	breaker := getBreaker(dsm.Ip)
+	err := breaker.allow()
+	if err == nil {
+		resp, err = dsm.sendRequestWithoutConnectionCheck(data, apiTemplate, params, cgiPath)
+		breaker.done(err != nil && resp.ErrorCode == 0) // a DSM error code means the DSM is reachable
+	}
+	metrics.ObserveWebapiRequest(dsm.Ip, params.Get("api"), params.Get("method"), start, resp.ErrorCode, err)
+	form, _ := url.ParseQuery(data) // encoded by url.Values
+	audit.Log(dsm.ctx, dsm.Ip, dsm.Serial, params, form, start, resp.ErrorCode, err)
+
+	if resp.ErrorCode != 0 {
+		span.SetAttributes(attribute.Int("webapi.error_code", resp.ErrorCode))
 	}
+	// the url in the errors of the http client has the query, e.g. the password of the login request, which End masks
+	tracing.End(span, err)
 
 	return resp, err
 }
 
 func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate interface{}, params url.Values, cgiPath string) (Response, error) {
-	client := &http.Client{}
+	client := &http.Client{Transport: getTransport(dsm.Https, dsm.IpFamily)}
 	var req *http.Request
 	var err error
 	var cgiUrl string
 
-	// Ex: http://10.12.12.14:5000/webapi/auth.cgi
+	// Ex: http://10.12.12.14:5000/webapi/auth.cgi, http://[fd00::14]:5000/webapi/auth.cgi
+	hostPort := net.JoinHostPort(dsm.Ip, strconv.Itoa(dsm.Port))
 	if dsm.Https {
-		// TODO: input CA certificate and fill in tls config
-		// Skip Verify when https
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client = &http.Client{Transport: tr}
-		cgiUrl = fmt.Sprintf("https://%s:%d/%s", dsm.Ip, dsm.Port, cgiPath)
+		cgiUrl = fmt.Sprintf("https://%s/%s", hostPort, cgiPath)
 	} else {
-		cgiUrl = fmt.Sprintf("http://%s:%d/%s", dsm.Ip, dsm.Port, cgiPath)
+		cgiUrl = fmt.Sprintf("http://%s/%s", hostPort, cgiPath)
 	}
 
 	baseUrl, err := url.Parse(cgiUrl)
@@ -83,14 +193,21 @@ func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate inter
 	baseUrl.RawQuery = params.Encode()
 
 	if logger.WebapiDebug {
-		log.Debugln(baseUrl.RawQuery)
+		dsm.Logger().Debugln(baseUrl.RawQuery)
 	}
 
+	// the secrets are sent as the form data of a POST, so they aren't in the query strings logged by DSM or proxies
 	if data != "" {
-		req, err = http.NewRequest("POST", baseUrl.String(), nil)
+		req, err = http.NewRequest("POST", baseUrl.String(), strings.NewReader(data))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
 	} else {
 		req, err = http.NewRequest("GET", baseUrl.String(), nil)
 	}
+	if err != nil {
+		return Response{}, err
+	}
 
 	if dsm.Sid != "" {
 		cookie := http.Cookie{Name: "id", Value: dsm.Sid}
@@ -111,7 +228,7 @@ func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate inter
 			return Response{}, err
 		}
 		s := string(bodyText)
-		log.Debugln(s)
+		dsm.Logger().Debugln(s)
 	}
 
 	if resp.StatusCode != 200 && resp.StatusCode != 302 {
@@ -175,7 +292,7 @@ func (dsm *DSM) Login() error {
 		Sid string `json:"sid"`
 	}
 
-	resp, err := dsm.sendRequestWithoutConnectionCheck("", &LoginResp{}, params, "webapi/auth.cgi")
+	resp, err := dsm.sendRequestWithMetrics("", &LoginResp{}, params, "webapi/auth.cgi")
 	if err != nil {
 		r, _ := regexp.Compile("passwd=.*&")
 		temp := r.ReplaceAllString(err.Error(), "")
@@ -188,6 +305,9 @@ func (dsm *DSM) Login() error {
 		return fmt.Errorf("Failed to assert response to %T", &LoginResp{})
 	}
 	dsm.Sid = loginResp.Sid
+	if dsm.parent != nil {
+		dsm.parent.Sid = loginResp.Sid
+	}
 
 	return nil
 }
@@ -199,7 +319,7 @@ func (dsm *DSM) Logout() error {
 	params.Add("method", "logout")
 	params.Add("version", "1")
 
-	_, err := dsm.sendRequestWithoutConnectionCheck("", &struct{}{}, params, "webapi/entry.cgi")
+	_, err := dsm.sendRequestWithMetrics("", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,37 @@
+// Copyright 2023 Synology Inc.
+
+package webapi
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// the request received by the stub DSM
+type stubRequest struct {
+	method string
+	query  url.Values
+	form   url.Values
+}
+
+// newStubDsm returns a DSM whose webapi calls succeed with no data, and the requests it receives
+func newStubDsm(t *testing.T) (*DSM, *[]stubRequest) {
+	requests := []stubRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm() error = %v", err)
+		}
+		requests = append(requests, stubRequest{method: r.Method, query: query, form: r.PostForm})
+		w.Write([]byte(`{"success":true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return &DSM{Ip: host, Port: portNum, Sid: "sid"}, &requests
+}
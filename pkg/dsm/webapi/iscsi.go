@@ -8,7 +8,6 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
-	log "github.com/sirupsen/logrus"
 	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 )
@@ -16,6 +15,7 @@ import (
 type LunInfo struct {
 	Name             string `json:"name"`
 	Uuid             string `json:"uuid"`
+	Description      string `json:"description"`
 	LunType          int    `json:"type"`
 	Location         string `json:"location"`
 	Size             uint64 `json:"size"`
@@ -35,6 +35,9 @@ type ConncetedSession struct {
 	Ip  string `json:"ip"`
 }
 
+// the interface name of the network portal of a target which listens on all interfaces
+const NetworkPortalAllInterfaces = "all"
+
 type NetworkPortal struct {
 	ControllerId  int    `json:"controller_id"`
 	InterfaceName string `json:"interface_name"`
@@ -259,7 +262,7 @@ func (dsm *DSM) TargetList() ([]TargetInfo, error) {
 	params.Add("api", "SYNO.Core.ISCSI.Target")
 	params.Add("method", "list")
 	params.Add("version", "1")
-	params.Add("additional", "[\"mapped_lun\", \"connected_sessions\"]")
+	params.Add("additional", "[\"mapped_lun\", \"connected_sessions\", \"network_portal\"]")
 
 	type TargetInfos struct {
 		Targets []TargetInfo `json:"targets"`
@@ -283,7 +286,7 @@ func (dsm *DSM) TargetGet(targetId string) (TargetInfo, error) {
 	params.Add("method", "get")
 	params.Add("version", "1")
 	params.Add("target_id", strconv.Quote(targetId))
-	params.Add("additional", "[\"mapped_lun\", \"connected_sessions\"]")
+	params.Add("additional", "[\"mapped_lun\", \"connected_sessions\", \"network_portal\"]")
 
 	type Info struct {
 		Target TargetInfo `json:"target"`
@@ -315,6 +318,28 @@ func (dsm *DSM) TargetSet(targetId string, maxSession int) error {
 	return nil
 }
 
+// Bind the target to the given network portals, the target listens on all interfaces if none is given
+func (dsm *DSM) TargetSetNetworkPortals(targetId string, portals []NetworkPortal) error {
+	portalsJson, err := json.Marshal(portals)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.ISCSI.Target")
+	params.Add("method", "set")
+	params.Add("version", "1")
+	params.Add("target_id", strconv.Quote(targetId))
+	params.Add("network_portals", string(portalsJson))
+
+	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	if err != nil {
+		return errCodeMapping(resp.ErrorCode, err)
+	}
+
+	return nil
+}
+
 func (dsm *DSM) TargetCreate(spec TargetCreateSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.Target")
@@ -350,7 +375,7 @@ func (dsm *DSM) LunMapTarget(targetIds []string, lunUuid string) error {
 	params.Add("target_ids", fmt.Sprintf("[%s]", strings.Join(targetIds, ",")))
 
 	if logger.WebapiDebug {
-		log.Debugln(params)
+		dsm.Logger().Debugln(params)
 	}
 
 	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
@@ -8,7 +8,6 @@ import (
 	"net/url"
 	"strconv"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
 )
@@ -21,6 +20,8 @@ type ShareInfo struct {
 	EnableRecycleBin    bool   `json:"enable_recycle_bin"`
 	RecycleBinAdminOnly bool   `json:"recycle_bin_admin_only"`
 	Encryption          int    `json:"encryption"`                  // field for create
+	SmbEncryption       bool   `json:"enable_smb_encryption"`       // field for get, SMB3 encryption is required by the share
+	EncPasswd           string `json:"enc_passwd,omitempty"`        // field for create, the key of an encrypted share
 	QuotaForCreate      *int64 `json:"share_quota,omitempty"`
 	QuotaValueInMB      int64  `json:"quota_value"`                 // field for get
 	SupportSnapshot     bool   `json:"support_snapshot"`            // field for get
@@ -28,10 +29,18 @@ type ShareInfo struct {
 	NameOrg             string `json:"name_org"`                    // required for clone
 }
 
+// values of ShareInfo.Encryption
+const (
+	ShareEncryptionNone      = 0
+	ShareEncryptionMounted   = 1 // encrypted and unlocked
+	ShareEncryptionUnmounted = 2 // encrypted and locked, e.g. after DSM reboots
+)
+
 type ShareUpdateInfo struct {
 	Name                string `json:"name"`                        // required
 	VolPath             string `json:"vol_path"`                    // required
 	QuotaForCreate      *int64 `json:"share_quota,omitempty"`
+	SmbEncryption       *bool  `json:"enable_smb_encryption,omitempty"`
 	// Add properties you want to update to shares here
 }
 
@@ -63,7 +72,7 @@ type ShareSnapshotCreateSpec struct {
 
 type SharePermissionSetSpec struct {
 	Name          string
-	UserGroupType string            // "local_user"/"local_group"/"system"
+	UserGroupType string            // "local_user"/"local_group"/"system"/"domain_user"/"domain_group"
 	Permissions   []*SharePermission
 }
 
@@ -102,7 +111,7 @@ func (dsm *DSM) ShareGet(shareName string) (ShareInfo, error) {
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "get")
 	params.Add("version", "1")
-	params.Add("additional", "[\"encryption\", \"enable_share_cow\", \"recyclebin\", \"support_snapshot\", \"share_quota\"]")
+	params.Add("additional", "[\"encryption\", \"enable_share_cow\", \"recyclebin\", \"support_snapshot\", \"share_quota\", \"enable_smb_encryption\"]")
 	params.Add("name", strconv.Quote(shareName))
 
 	info := ShareInfo{}
@@ -117,7 +126,7 @@ func (dsm *DSM) ShareList() ([]ShareInfo, error) {
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "list")
 	params.Add("version", "1")
-	params.Add("additional", "[\"encryption\", \"enable_share_cow\", \"recyclebin\", \"support_snapshot\", \"share_quota\"]")
+	params.Add("additional", "[\"encryption\", \"enable_share_cow\", \"recyclebin\", \"support_snapshot\", \"share_quota\", \"enable_smb_encryption\"]")
 
 	type ShareInfos struct {
 		Shares []ShareInfo `json:"shares"`
@@ -147,9 +156,11 @@ func (dsm *DSM) ShareCreate(spec ShareCreateSpec) error {
 	if err != nil {
 		return err
 	}
-	params.Add("shareinfo", string(js))
+	// the shareinfo has the key of an encrypted share
+	form := url.Values{}
+	form.Add("shareinfo", string(js))
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(form.Encode(), &struct{}{}, params, "webapi/entry.cgi")
 
 	return shareErrCodeMapping(resp.ErrorCode, err)
 }
@@ -220,7 +231,7 @@ func (dsm *DSM) ShareSet(shareName string, updateInfo ShareUpdateInfo) error {
 	params.Add("shareinfo", string(js))
 
 	if logger.WebapiDebug {
-		log.Debugln(params)
+		dsm.Logger().Debugln(params)
 	}
 
 	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
@@ -237,6 +248,15 @@ func (dsm *DSM) SetShareQuota(shareInfo ShareInfo, newSizeInMB int64) error {
 	return dsm.ShareSet(shareInfo.Name, updateInfo)
 }
 
+func (dsm *DSM) SetShareSmbEncryption(shareInfo ShareInfo, enable bool) error {
+	updateInfo := ShareUpdateInfo{
+		Name:          shareInfo.Name,
+		VolPath:       shareInfo.VolPath,
+		SmbEncryption: &enable,
+	}
+	return dsm.ShareSet(shareInfo.Name, updateInfo)
+}
+
 // ----------------------- Share Snapshot APIs -----------------------
 func (dsm *DSM) ShareSnapshotCreate(spec ShareSnapshotCreateSpec) (string, error) {
 	params := url.Values{}
@@ -316,6 +336,23 @@ func (dsm *DSM) ShareSnapshotDelete(snapTime string, shareName string) error {
 	return nil
 }
 
+// ----------------------- Share Crypto APIs -----------------------
+// Mount an encrypted share with its key
+func (dsm *DSM) ShareDecrypt(shareName string, password string) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.Share.Crypto")
+	params.Add("method", "decrypt")
+	params.Add("version", "1")
+	params.Add("name", strconv.Quote(shareName))
+
+	form := url.Values{}
+	form.Add("password", jsonString(password))
+
+	resp, err := dsm.sendRequest(form.Encode(), &struct{}{}, params, "webapi/entry.cgi")
+
+	return shareErrCodeMapping(resp.ErrorCode, err)
+}
+
 // ----------------------- Share Permission APIs -----------------------
 func (dsm *DSM) SharePermissionSet(spec SharePermissionSetSpec) error {
 	params := url.Values{}
@@ -0,0 +1,75 @@
+// Copyright 2023 Synology Inc.
+
+package webapi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/audit"
+)
+
+func TestDSM_ShareDecrypt(t *testing.T) {
+	dsm, requests := newStubDsm(t)
+
+	if err := dsm.ShareDecrypt("pvc-1", "pass\x01word"); err != nil {
+		t.Fatalf("ShareDecrypt() error = %v", err)
+	}
+
+	if len(*requests) != 1 {
+		t.Fatalf("ShareDecrypt() sent %d requests, want 1", len(*requests))
+	}
+	request := (*requests)[0]
+	if request.method != "POST" {
+		t.Errorf("ShareDecrypt() method = %v, want POST", request.method)
+	}
+	if got := request.query.Get("name"); got != `"pvc-1"` {
+		t.Errorf("ShareDecrypt() name = %v, want %v", got, `"pvc-1"`)
+	}
+	if request.query.Has("password") {
+		t.Errorf("ShareDecrypt() sent the password in the query")
+	}
+	if got := request.form.Get("password"); got != `"pass\u0001word"` {
+		t.Errorf("ShareDecrypt() password = %v, want %v", got, `"pass\u0001word"`)
+	}
+}
+
+func TestDSM_ShareCreate_audit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Init(audit.Config{Sink: audit.SinkFile, File: file}); err != nil {
+		t.Fatalf("audit.Init() error = %v", err)
+	}
+	defer audit.Close()
+
+	dsm, requests := newStubDsm(t)
+	spec := ShareCreateSpec{
+		Name:      "pvc-1",
+		ShareInfo: ShareInfo{Name: "pvc-1", VolPath: "/volume1", Encryption: 1, EncPasswd: "Pa55word"},
+	}
+	if err := dsm.ShareCreate(spec); err != nil {
+		t.Fatalf("ShareCreate() error = %v", err)
+	}
+
+	if got := (*requests)[0].form.Get("shareinfo"); !strings.Contains(got, `"enc_passwd":"Pa55word"`) {
+		t.Errorf("ShareCreate() shareinfo = %v, want the key of the share", got)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	record := audit.Record{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if record.Api != "SYNO.Core.Share" || record.Method != "create" || record.Params["name"] != `"pvc-1"` {
+		t.Errorf("audit record = %+v, want SYNO.Core.Share.create of pvc-1", record)
+	}
+	shareInfo := record.Form["shareinfo"]
+	if !strings.Contains(shareInfo, `"vol_path":"/volume1"`) || !strings.Contains(shareInfo, `"enc_passwd":"***"`) || strings.Contains(shareInfo, "Pa55word") {
+		t.Errorf("audit record shareinfo = %v, want the attributes with the key masked", shareInfo)
+	}
+}
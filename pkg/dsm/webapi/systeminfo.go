@@ -4,6 +4,7 @@ package webapi
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"strings"
 )
@@ -26,6 +27,24 @@ type NetworkInterface struct {
 	Status     string `json:"status"`
 	Type       string `json:"type"`
 	UseDhcp    bool   `json:"use_dhcp"`
+	Ipv6       []string `json:"ipv6"` // e.g. "fd00::1/64"
+}
+
+// Ips returns the IPv4 and the global IPv6 addresses of the interface, the IPv6 prefix length is stripped
+func (netIf NetworkInterface) Ips() []string {
+	ips := []string{}
+	if netIf.Ip != "" {
+		ips = append(ips, netIf.Ip)
+	}
+
+	for _, addr := range netIf.Ipv6 {
+		ip := net.ParseIP(strings.Split(addr, "/")[0])
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips
 }
 
 func (dsm *DSM) DsmInfoGet() (*DsmInfo, error) {
@@ -0,0 +1,90 @@
+// Copyright 2023 Synology Inc.
+
+package webapi
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+type UserInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Expired     string `json:"expired"`
+}
+
+// ----------------------- User APIs -----------------------
+func (dsm *DSM) UserList() ([]UserInfo, error) {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.User")
+	params.Add("method", "list")
+	params.Add("version", "1")
+	params.Add("type", "local")
+	params.Add("offset", "0")
+	params.Add("limit", "-1")
+	params.Add("additional", "[\"description\", \"expired\"]")
+
+	type UserInfos struct {
+		Users []UserInfo `json:"users"`
+	}
+
+	resp, err := dsm.sendRequest("", &UserInfos{}, params, "webapi/entry.cgi")
+	if err != nil {
+		return nil, err
+	}
+
+	infos, ok := resp.Data.(*UserInfos)
+	if !ok {
+		return nil, fmt.Errorf("Failed to assert response to %T", &UserInfos{})
+	}
+
+	return infos.Users, nil
+}
+
+func (dsm *DSM) UserCreate(name string, password string, description string) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.User")
+	params.Add("method", "create")
+	params.Add("version", "1")
+	params.Add("name", strconv.Quote(name))
+	params.Add("description", strconv.Quote(description))
+	params.Add("expired", strconv.Quote("normal"))
+	params.Add("cannot_chg_passwd", "true")
+	params.Add("notify_by_email", "false")
+	params.Add("send_password", "false")
+
+	form := url.Values{}
+	form.Add("password", jsonString(password))
+
+	_, err := dsm.sendRequest(form.Encode(), &struct{}{}, params, "webapi/entry.cgi")
+
+	return err
+}
+
+func (dsm *DSM) UserSetPassword(name string, password string) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.User")
+	params.Add("method", "set")
+	params.Add("version", "1")
+	params.Add("name", strconv.Quote(name))
+
+	form := url.Values{}
+	form.Add("password", jsonString(password))
+
+	_, err := dsm.sendRequest(form.Encode(), &struct{}{}, params, "webapi/entry.cgi")
+
+	return err
+}
+
+func (dsm *DSM) UserDelete(name string) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.User")
+	params.Add("method", "delete")
+	params.Add("version", "1")
+	params.Add("name", fmt.Sprintf("[%s]", strconv.Quote(name)))
+
+	_, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+
+	return err
+}
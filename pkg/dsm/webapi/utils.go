@@ -3,30 +3,60 @@
 package webapi
 
 import (
+	"encoding/json"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"math/bits"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 )
 
+// jsonString encodes the value of a SYNO.Core parameter, which DSM decodes as JSON, e.g. a name is sent as "\"name\"".
+// strconv.Quote gives the same for the printable names, but not for the control characters a passphrase may have.
+func jsonString(s string) string {
+	js, _ := json.Marshal(s)
+	return string(js)
+}
+
 func (dsm *DSM) IsUC() bool {
 	dsmSysInfo, err := dsm.DsmSystemInfoGet()
     if err != nil {
-        log.Errorf("Failed to get DSM[%s] system info", dsm.Ip)
+        dsm.Logger().Errorf("Failed to get DSM[%s] system info", dsm.Ip)
         return false
     }
 	return strings.Contains(dsmSysInfo.FirmwareVer, "DSM UC")
 }
 
+// UnlockShare mounts the encrypted share if it is locked, nothing to do for a plain share
+func (dsm *DSM) UnlockShare(shareName string, password string) error {
+	shareInfo, err := dsm.ShareGet(shareName)
+	if err != nil {
+		return err
+	}
+
+	if shareInfo.Encryption != ShareEncryptionUnmounted {
+		return nil
+	}
+
+	if password == "" {
+		return fmt.Errorf("Share [%s] is encrypted, but no key is given", shareName)
+	}
+
+	dsm.Logger().Infof("[%s] Going to unlock encrypted share [%s]", dsm.Ip, shareName)
+	return dsm.ShareDecrypt(shareName, password)
+}
+
 func (dsm *DSM) GetAnotherController() (*DSM, error) {
 	anotherDsm := &DSM{
 		Port:     dsm.Port,
 		Username: dsm.Username,
 		Password: dsm.Password,
 		Https:    dsm.Https,
+		IpFamily: dsm.IpFamily,
 	}
 
 	netListA, err := dsm.NetworkInterfaceList("node0")
@@ -39,16 +69,17 @@ func (dsm *DSM) GetAnotherController() (*DSM, error) {
 		return nil, fmt.Errorf("Failed to get DSM network list of controller B. %v", err)
 	}
 
-	ips, err := utils.LookupIPv4(dsm.Ip) // because dsm.Ip may be a domain
+	ips, err := utils.LookupIP(dsm.Ip, dsm.IpFamily) // because dsm.Ip may be a domain
 	if err != nil {
 		return nil, err
 	}
+	localIp := net.ParseIP(ips[0])
 
 	dsm.Controller = "A"
 	anotherDsm.Controller = "B"
 	anotherList := netListB
 	for _, netIf := range netListB {
-		if netIf.Ip == ips[0] {
+		if utils.SliceContains(netIf.Ips(), ips[0]) {
 			dsm.Controller = "B"
 			anotherDsm.Controller = "A"
 			anotherList = netListA
@@ -56,40 +87,67 @@ func (dsm *DSM) GetAnotherController() (*DSM, error) {
 		}
 	}
 
-	ipPrefix := ips[0]
-	for i := 0; i < 4; i++ {
-		dotPos := strings.LastIndex(ipPrefix, ".")
-
-		if dotPos == -1 {
-			ipPrefix = ""
-		} else {
-			ipPrefix = ipPrefix[:dotPos]
+	// prefer the addresses of the same family and the longest common prefix, which are most likely in the same subnet
+	candidates := []string{}
+	for _, netIf := range anotherList {
+		if netIf.Status != "connected" {
+			continue
 		}
-
-		for _, netIf := range anotherList {
-			if ipPrefix != "" && !strings.HasPrefix(netIf.Ip, ipPrefix) {
-				continue
-			}
-
-			if netIf.Status == "connected" && CheckIpReachable(netIf.Ip, anotherDsm.Port){
-				anotherDsm.Ip = netIf.Ip
-				return anotherDsm, nil
+		for _, ip := range netIf.Ips() {
+			if commonPrefixLen(localIp, net.ParseIP(ip)) >= 0 {
+				candidates = append(candidates, ip)
 			}
 		}
 	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return commonPrefixLen(localIp, net.ParseIP(candidates[i])) > commonPrefixLen(localIp, net.ParseIP(candidates[j]))
+	})
+
+	for _, ip := range candidates {
+		if CheckIpReachable(ip, anotherDsm.Port) {
+			anotherDsm.Ip = ip
+			return anotherDsm, nil
+		}
+	}
 
 	return nil, fmt.Errorf("Failed to get reachable network of another controller.")
 }
 
+// returns the number of leading bits in common, or -1 if the addresses are of different families
+func commonPrefixLen(a net.IP, b net.IP) int {
+	if a == nil || b == nil {
+		return -1
+	}
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		if a4 == nil || b4 == nil {
+			return -1
+		}
+		a, b = a4, b4
+	}
+
+	n := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		n += bits.LeadingZeros8(x)
+		break
+	}
+	return n
+}
+
 func CheckIpReachable(ip string, port int) bool {
 	seconds := 5
 	timeOut := time.Duration(seconds) * time.Second
 
-	_, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ip, port), timeOut)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeOut)
 
 	if err != nil {
 		return false
 	}
+	conn.Close()
 
 	return true
 }
@@ -0,0 +1,51 @@
+// Copyright 2023 Synology Inc.
+
+package webapi
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_commonPrefixLen(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want int
+	}{
+		{name: "same ipv4", a: "10.0.0.1", b: "10.0.0.1", want: 32},
+		{name: "same /24", a: "10.0.0.1", b: "10.0.0.200", want: 24},
+		{name: "different /8", a: "10.0.0.1", b: "192.168.0.1", want: 0},
+		{name: "ipv6", a: "fd00::1", b: "fd00::2", want: 126},
+		{name: "ipv4 and ipv4-mapped ipv6", a: "10.0.0.1", b: "::ffff:10.0.0.1", want: 32},
+		{name: "different families", a: "10.0.0.1", b: "fd00::1", want: -1},
+		{name: "invalid", a: "10.0.0.1", b: "invalid", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commonPrefixLen(net.ParseIP(tt.a), net.ParseIP(tt.b)); got != tt.want {
+				t.Errorf("commonPrefixLen() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_jsonString(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "printable", s: `pa"ss\word`, want: `"pa\"ss\\word"`},
+		{name: "control", s: "pass\x01word", want: `"pass\u0001word"`},
+		{name: "unicode", s: "密碼", want: `"密碼"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonString(tt.s); got != tt.want {
+				t.Errorf("jsonString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
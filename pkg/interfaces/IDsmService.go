@@ -3,6 +3,8 @@
 package interfaces
 
 import (
+	"context"
+
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/models"
@@ -15,6 +17,8 @@ type IDsmService interface {
 	RemoveAllDsms()
 	GetDsm(ip string) (*webapi.DSM, error)
 	GetDsmsCount() int
+	WithContext(ctx context.Context) IDsmService
+	ListDsms() []*webapi.DSM
 	ListDsmVolumes(ip string) ([]webapi.VolInfo, error)
 	CreateVolume(spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error)
 	DeleteVolume(volId string) error
@@ -0,0 +1,62 @@
+// Copyright 2023 Synology Inc.
+
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the fields of the log entries of a CSI request
+const (
+	RequestIdKey = "request_id"
+	VolumeIdKey  = "volume_id"
+	DsmKey       = "dsm"
+)
+
+type fieldsKey struct{}
+
+// NewRequestId returns a random ID to correlate the log entries of a CSI request
+func NewRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithFields returns a copy of ctx whose log entries carry the fields in addition to the ones of ctx
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	merged := logrus.Fields{}
+	if parent, ok := ctx.Value(fieldsKey{}).(logrus.Fields); ok {
+		for k, v := range parent {
+			merged[k] = v
+		}
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FromContext returns the log entry with the fields of ctx, which may be nil
+func FromContext(ctx context.Context) *logrus.Entry {
+	if ctx == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	fields, _ := ctx.Value(fieldsKey{}).(logrus.Fields)
+	return logrus.WithFields(fields)
+}
+
+// RequestId returns the request ID of ctx, or empty if ctx is not of a CSI request
+func RequestId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	fields, _ := ctx.Value(fieldsKey{}).(logrus.Fields)
+	id, _ := fields[RequestIdKey].(string)
+	return id
+}
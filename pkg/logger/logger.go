@@ -18,6 +18,9 @@ var WebapiDebug = false
 const (
 	DefaultLogLevel = logrus.InfoLevel
 	DefaultTimestampFormat = time.RFC3339
+
+	LogFormatText = "text"
+	LogFormatJson = "json"
 )
 
 type CallerHook struct {
@@ -85,14 +88,25 @@ func setLogLevel(logLevel string) {	// debug, info, warn, error, fatal
 	return
 }
 
-func Init(logLevel string) {
-	logrus.AddHook(NewCallerHook())
-	logrus.SetOutput(os.Stdout)
-	setLogLevel(logLevel)
+func setLogFormat(logFormat string) { // text, json
+	if logFormat == LogFormatJson {
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: DefaultTimestampFormat,
+		})
+		return
+	}
 	logrus.SetFormatter(&nested.Formatter{
 		HideKeys: true,
 		TimestampFormat: DefaultTimestampFormat,
 		ShowFullLevel: true,
 		NoColors: true,
 	})
+}
+
+func Init(logLevel string, logFormat string) {
+	logrus.AddHook(NewCallerHook())
+	logrus.AddHook(defaultRedactHook)
+	logrus.SetOutput(os.Stdout)
+	setLogLevel(logLevel)
+	setLogFormat(logFormat)
 }
\ No newline at end of file
@@ -0,0 +1,98 @@
+// Copyright 2023 Synology Inc.
+
+package logger
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	redacted = "***"
+
+	// the shorter values are only masked by their keys, replacing them everywhere would mangle the logs,
+	// e.g. a password "csi" masks every "csi" of the driver name
+	MinRegisteredSecretLen = 8
+)
+
+var (
+	// e.g. "passwd=xxx&" of the webapi queries, "enc_passwd":"xxx" of the json bodies, map[password:["xxx"]] of the
+	// webapi parameters and "password: xxx" of the yaml configs
+	secretValueRegexp = regexp.MustCompile(`(?i)((?:passwd|password|passphrase|secret|token|keytab|_sid)["']?\s*[:=]\s*\[?["']?)[^"'&\s,}\]]+`)
+	secretKeyRegexp   = regexp.MustCompile(`(?i)(passwd|password|passphrase|secret|token|keytab|_sid)`)
+
+	defaultRedactHook = &RedactHook{}
+)
+
+// RedactHook masks the secrets in the message and the fields of every log entry,
+// the ones in known formats and the values registered by RegisterSecret
+type RedactHook struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+func (hook *RedactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *RedactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = hook.Redact(entry.Message)
+	for key, value := range entry.Data {
+		if IsSecretKey(key) {
+			entry.Data[key] = redacted
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = hook.Redact(v)
+		case error:
+			entry.Data[key] = hook.Redact(v.Error())
+		}
+	}
+	return nil
+}
+
+func (hook *RedactHook) Redact(s string) string {
+	s = secretValueRegexp.ReplaceAllString(s, "${1}"+redacted)
+
+	hook.mu.RLock()
+	defer hook.mu.RUnlock()
+	for _, secret := range hook.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+func (hook *RedactHook) Register(secret string) {
+	if len(secret) < MinRegisteredSecretLen {
+		return
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	for _, s := range hook.secrets {
+		if s == secret {
+			return
+		}
+	}
+	hook.secrets = append(hook.secrets, secret)
+}
+
+// RegisterSecret masks the value in all log entries, e.g. the passwords of DSMs which may be logged in any format.
+// The values shorter than MinRegisteredSecretLen are ignored.
+func RegisterSecret(secret string) {
+	defaultRedactHook.Register(secret)
+}
+
+// Redact masks the secrets in s, e.g. the parameters of the webapi calls written to the audit log
+func Redact(s string) string {
+	return defaultRedactHook.Redact(s)
+}
+
+// IsSecretKey tells if the value of the field or the parameter is a secret
+func IsSecretKey(key string) bool {
+	return secretKeyRegexp.MatchString(key)
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 Synology Inc.
+
+package logger
+
+import (
+	"testing"
+)
+
+func TestRedactHook_Redact(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+		s       string
+		want    string
+	}{
+		{name: "query", s: "Get http://10.0.0.1:5000/webapi/auth.cgi?account=admin&passwd=Pa55word&format=sid", want: "Get http://10.0.0.1:5000/webapi/auth.cgi?account=admin&passwd=***&format=sid"},
+		{name: "json", s: `{"name":"lun","enc_passwd":"Pa55word"}`, want: `{"name":"lun","enc_passwd":"***"}`},
+		{name: "params", s: `map[api:[SYNO.Core.User] password:["Pa55word"]]`, want: `map[api:[SYNO.Core.User] password:["***"]]`},
+		{name: "yaml", s: "username: admin\npassword: Pa55word\n", want: "username: admin\npassword: ***\n"},
+		{name: "registered", secrets: []string{"Pa55word"}, s: "chap Pa55word", want: "chap ***"},
+		{name: "registered too short", secrets: []string{"csi"}, s: "synology-csi", want: "synology-csi"},
+		{name: "no secrets", s: "Created LUN k8s-csi-pvc-1", want: "Created LUN k8s-csi-pvc-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &RedactHook{}
+			for _, secret := range tt.secrets {
+				hook.Register(secret)
+			}
+			if got := hook.Redact(tt.s); got != tt.want {
+				t.Errorf("RedactHook.Redact() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSecretKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{name: "passwd", key: "passwd", want: true},
+		{name: "upper case", key: "ENC_PASSWD", want: true},
+		{name: "sid", key: "_sid", want: true},
+		{name: "not secret", key: "account", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsSecretKey(tt.key); got != tt.want {
+				t.Errorf("IsSecretKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
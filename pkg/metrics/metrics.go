@@ -0,0 +1,105 @@
+// Copyright 2023 Synology Inc.
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "synology_csi"
+
+var (
+	GrpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of CSI gRPC requests by method and status code.",
+	}, []string{"method", "code"})
+
+	GrpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Latency of CSI gRPC requests by method.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method"})
+
+	WebapiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dsm_webapi_requests_total",
+		Help:      "Number of DSM webapi requests by DSM, API, method and result, which is 'success', the DSM error code or 'error'.",
+	}, []string{"dsm", "api", "method", "result"})
+
+	WebapiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dsm_webapi_request_duration_seconds",
+		Help:      "Latency of DSM webapi requests by DSM, API and method.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"dsm", "api", "method"})
+
+	DsmRelogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dsm_relogins_total",
+		Help:      "Number of re-logins to DSM after the session expired, by DSM and result.",
+	}, []string{"dsm", "result"})
+
+	ReclaimedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reclaimed_bytes_total",
+		Help:      "Number of bytes trimmed by fstrim on the staged thin volumes of the node.",
+	})
+
+	AuditRecordsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_records_dropped_total",
+		Help:      "Number of audit records not written by reason, which is 'queue_full' or 'error'.",
+	}, []string{"reason"})
+
+	DsmCircuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dsm_circuit_breaker_state",
+		Help:      "State of the circuit breaker of the DSM webapi calls by DSM, 0 closed, 1 half-open, 2 open.",
+	}, []string{"dsm"})
+)
+
+func init() {
+	prometheus.MustRegister(GrpcRequests, GrpcDuration, WebapiRequests, WebapiDuration, DsmRelogins, ReclaimedBytes, AuditRecordsDropped,
+		DsmCircuitBreakerState)
+}
+
+// ObserveWebapiRequest records a webapi request, errorCode is the DSM error code of a failed API, or 0 for other errors
+func ObserveWebapiRequest(dsmIp string, api string, method string, start time.Time, errorCode int, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+		if errorCode != 0 {
+			result = strconv.Itoa(errorCode)
+		}
+	}
+
+	WebapiRequests.WithLabelValues(dsmIp, api, method, result).Inc()
+	WebapiDuration.WithLabelValues(dsmIp, api, method).Observe(time.Since(start).Seconds())
+}
+
+func ObserveRelogin(dsmIp string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	DsmRelogins.WithLabelValues(dsmIp, result).Inc()
+}
+
+// Serve exposes the registered metrics on "<address>/metrics"
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("Serving metrics on %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Errorf("Failed to serve metrics on %s: %v", address, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Synology Inc.
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveWebapiRequest(t *testing.T) {
+	WebapiRequests.Reset()
+	WebapiDuration.Reset()
+
+	tests := []struct {
+		name       string
+		errorCode  int
+		err        error
+		wantResult string
+	}{
+		{
+			name:       "success",
+			wantResult: "success",
+		},
+		{
+			name:       "DSM error code",
+			errorCode:  18990002,
+			err:        errors.New("DSM Api error. Error code:18990002"),
+			wantResult: "18990002",
+		},
+		{
+			name:       "connection error",
+			err:        errors.New("dial tcp 10.0.0.1:5000: i/o timeout"),
+			wantResult: "error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ObserveWebapiRequest("10.0.0.1", "SYNO.Core.ISCSI.LUN", "create", time.Now(), tt.errorCode, tt.err)
+
+			got := testutil.ToFloat64(WebapiRequests.WithLabelValues("10.0.0.1", "SYNO.Core.ISCSI.LUN", "create", tt.wantResult))
+			if got != 1 {
+				t.Errorf("webapi requests of result %v = %v, want 1", tt.wantResult, got)
+			}
+		})
+	}
+
+	// the errors don't add series, only the results above
+	if got := testutil.CollectAndCount(WebapiRequests); got != len(tests) {
+		t.Errorf("webapi request series = %v, want %v", got, len(tests))
+	}
+	if got := testutil.CollectAndCount(WebapiDuration); got != 1 {
+		t.Errorf("webapi duration series = %v, want 1", got)
+	}
+}
+
+func TestObserveWebapiRequest_cardinality(t *testing.T) {
+	WebapiRequests.Reset()
+
+	// the messages of the connection errors differ by port and time, they must not become label values
+	for i := 0; i < 100; i++ {
+		err := fmt.Errorf("dial tcp 10.0.0.1:%d: connection refused", 40000+i)
+		ObserveWebapiRequest("10.0.0.1", "SYNO.API.Info", "query", time.Now(), 0, err)
+	}
+
+	if got := testutil.CollectAndCount(WebapiRequests); got != 1 {
+		t.Errorf("webapi request series = %v, want 1", got)
+	}
+}
+
+func TestObserveRelogin(t *testing.T) {
+	DsmRelogins.Reset()
+
+	ObserveRelogin("10.0.0.1", nil)
+	ObserveRelogin("10.0.0.1", errors.New("wrong password"))
+	ObserveRelogin("10.0.0.1", errors.New("timeout"))
+
+	if got := testutil.ToFloat64(DsmRelogins.WithLabelValues("10.0.0.1", "error")); got != 2 {
+		t.Errorf("failed relogins = %v, want 2", got)
+	}
+	if got := testutil.CollectAndCount(DsmRelogins); got != 2 {
+		t.Errorf("relogin series = %v, want 2", got)
+	}
+}
@@ -28,15 +28,26 @@ const (
 	MaxIqnLen        = 128
 	MaxLunDescLen    = 127
 
+	// LUNs are packed into targets named "<TargetPrefix>-shared-<single|multi>-<n>" in shared target mode,
+	// the LUNs of RWO and RWX volumes never share a target as the max sessions apply to the whole target
+	SharedTargetInfix         = "shared"
+	SharedTargetSingleSession = "single"
+	SharedTargetMultiSession  = "multi"
+	MaxLunsPerSharedTarget    = 32
+
 	// Share definitions
-	MaxShareLen             = 32
-	MaxShareDescLen         = 64
-	UserGroupTypeLocalUser  = "local_user"
-	UserGroupTypeLocalGroup = "local_group"
-	UserGroupTypeSystem     = "system"
+	MaxShareLen              = 32
+	MaxShareDescLen          = 64
+	UserGroupTypeLocalUser   = "local_user"
+	UserGroupTypeLocalGroup  = "local_group"
+	UserGroupTypeSystem      = "system"
+	UserGroupTypeDomainUser  = "domain_user"
+	UserGroupTypeDomainGroup = "domain_group"
 
 	// CSI definitions
 	ShareSnapshotDescPrefix = "(Do not change)"
+	VolumeUserDesc          = "(Do not change) SMB user of the volume created by csi driver"
+	EphemeralDescPrefix     = "(Do not change) ephemeral"
 )
 
 var (
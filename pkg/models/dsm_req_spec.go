@@ -29,6 +29,10 @@ type CreateK8sVolumeSpec struct {
 	LunDescription   string
 	ShareDescription string
 	RecycleBin       bool
+	SharedTarget     bool
+	TargetInterfaces []string
+	Encrypted        bool
+	EncryptionKey    string // key of the encrypted share, from the provisioner secret
 }
 
 type K8sVolumeRespSpec struct {
@@ -74,6 +78,22 @@ type NodeStageVolumeSpec struct {
 	Dsm                string
 	Source             string
 	IsThinProvisioning bool
+	MultipathPortals   string
+	FsOptions          map[string]string // mkfs_options, mount_options, fs_block_size and xfs_reflink
+	ReclaimSpace       bool
+	Encrypted          bool
+	SmbOptions         map[string]string // smb_version, smb_seal, smb_multichannel, smb_cache, smb_uid, ...
+}
+
+// GetMappingIndex returns the mapping index of the volume's own LUN in its target,
+// which may be mapped with other LUNs
+func (spec *K8sVolumeRespSpec) GetMappingIndex() (int, error) {
+	for _, mapping := range spec.Target.MappedLuns {
+		if mapping.LunUuid == spec.Lun.Uuid {
+			return mapping.MappingIndex, nil
+		}
+	}
+	return -1, fmt.Errorf("LUN [%s] is not mapped to target [%s]", spec.Lun.Uuid, spec.Target.Iqn)
 }
 
 type ByVolumeId []*K8sVolumeRespSpec
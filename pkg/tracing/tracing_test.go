@@ -0,0 +1,93 @@
+// Copyright 2023 Synology Inc.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+)
+
+func newRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestEnd_redact(t *testing.T) {
+	recorder := newRecorder(t)
+	logger.RegisterSecret("dsm-password-1234")
+
+	tests := []struct {
+		name   string
+		err    error
+		secret string
+	}{
+		{
+			name:   "login url",
+			err:    errors.New(`Get "http://10.0.0.1:5000/webapi/auth.cgi?account=admin&passwd=p%40ss": dial tcp: i/o timeout`),
+			secret: "p%40ss",
+		},
+		{
+			name:   "registered secret",
+			err:    errors.New("mount failed: exit status 32, options: username=admin,dsm-password-1234"),
+			secret: "dsm-password-1234",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, span := Start(context.Background(), tt.name)
+			End(span, tt.err)
+
+			spans := recorder.Ended()
+			got := spans[len(spans)-1]
+			if got.Status().Code != codes.Error {
+				t.Errorf("status = %v, want %v", got.Status().Code, codes.Error)
+			}
+			if strings.Contains(got.Status().Description, tt.secret) {
+				t.Errorf("status = %v, has the secret", got.Status().Description)
+			}
+			for _, event := range got.Events() {
+				for _, attr := range event.Attributes {
+					if strings.Contains(attr.Value.Emit(), tt.secret) {
+						t.Errorf("event %v attribute %v = %v, has the secret", event.Name, attr.Key, attr.Value.Emit())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStartChild(t *testing.T) {
+	recorder := newRecorder(t)
+
+	// a background job without a traced request
+	_, span := StartChild(context.Background(), "webapi SYNO.API.Info.query")
+	End(span, nil)
+	if got := len(recorder.Ended()); got != 0 {
+		t.Errorf("spans without a parent = %v, want 0", got)
+	}
+
+	ctx, parent := Start(context.Background(), "/csi.v1.Node/NodeStageVolume")
+	_, child := StartChild(ctx, "iscsiadm login")
+	End(child, nil)
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("spans = %v, want 2", len(spans))
+	}
+	if spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("parent of %v = %v, want %v", spans[0].Name(), spans[0].Parent().SpanID(), spans[1].SpanContext().SpanID())
+	}
+}
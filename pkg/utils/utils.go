@@ -50,19 +50,56 @@ func StringToBoolean(value string) bool {
 	return value == "yes" || value == "true" || value == "1"
 }
 
-// Haven't supported IPv6 yet.
-func LookupIPv4(name string) ([]string, error) {
+// Address family preference of the DSM connections and iSCSI portals
+const (
+	IpFamilyIPv4 = "ipv4"
+	IpFamilyIPv6 = "ipv6"
+)
+
+// LookupIP resolves the name to IP addresses, the addresses of the preferred family come first.
+// IPv4 is preferred if the family is not specified.
+func LookupIP(name string, preferredFamily string) ([]string, error) {
 	ips, _ := net.LookupIP(name)
 
-	retIps := []string{}
+	ipv4s, ipv6s := []string{}, []string{}
 	for _, ip := range ips {
 		if ipv4 := ip.To4(); ipv4 != nil {
-			retIps = append(retIps, ipv4.String())
+			ipv4s = append(ipv4s, ipv4.String())
+		} else {
+			ipv6s = append(ipv6s, ip.String())
 		}
 	}
+
+	var retIps []string
+	if preferredFamily == IpFamilyIPv6 {
+		retIps = append(ipv6s, ipv4s...)
+	} else {
+		retIps = append(ipv4s, ipv6s...)
+	}
 	if len(retIps) > 0 {
 		return retIps, nil
 	}
 
-	return nil, fmt.Errorf("Failed to LookupIPv4 by local resolver for: %s", name)
+	return nil, fmt.Errorf("Failed to LookupIP by local resolver for: %s", name)
+}
+
+func IsIPv6(ip string) bool {
+	parsed := net.ParseIP(strings.Trim(ip, "[]"))
+	return parsed != nil && parsed.To4() == nil
+}
+
+// BracketHost wraps an IPv6 address in brackets for URLs and UNC paths, e.g. "//[fd00::1]/share"
+func BracketHost(host string) string {
+	if IsIPv6(host) && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+func ValidateIpFamily(family string) error {
+	switch family {
+	case "", IpFamilyIPv4, IpFamilyIPv6:
+		return nil
+	}
+	return fmt.Errorf("Invalid ip family: %s, should be %s or %s", family, IpFamilyIPv4, IpFamilyIPv6)
 }
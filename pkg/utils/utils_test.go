@@ -0,0 +1,79 @@
+// Copyright 2023 Synology Inc.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLookupIP(t *testing.T) {
+	type args struct {
+		name            string
+		preferredFamily string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "ipv4",
+			args: args{name: "10.0.0.1"},
+			want: []string{"10.0.0.1"},
+		},
+		{
+			name: "ipv4 preferring ipv6",
+			args: args{name: "10.0.0.1", preferredFamily: IpFamilyIPv6},
+			want: []string{"10.0.0.1"},
+		},
+		{
+			name: "ipv6",
+			args: args{name: "fd00::1", preferredFamily: IpFamilyIPv4},
+			want: []string{"fd00::1"},
+		},
+		{
+			name: "ipv4-mapped ipv6",
+			args: args{name: "::ffff:10.0.0.1"},
+			want: []string{"10.0.0.1"},
+		},
+		{
+			name:    "empty",
+			args:    args{name: ""},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LookupIP(tt.args.name, tt.args.preferredFamily)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LookupIP() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LookupIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBracketHost(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		want string
+	}{
+		{name: "ipv4", host: "10.0.0.1", want: "10.0.0.1"},
+		{name: "ipv6", host: "fd00::1", want: "[fd00::1]"},
+		{name: "bracketed ipv6", host: "[fd00::1]", want: "[fd00::1]"},
+		{name: "domain", host: "dsm.example.com", want: "dsm.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BracketHost(tt.host); got != tt.want {
+				t.Errorf("BracketHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}